@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/faan11/flatpak-compose/internal/model"
 	"github.com/faan11/flatpak-compose/internal/state"
+	"github.com/faan11/flatpak-compose/internal/utility"
 	"github.com/faan11/flatpak-compose/internal/view"
 	"log"
 	"os"
+	"strings"
 )
 
 func getValidFileName(defaultFileName string) (string, error) {
@@ -29,18 +33,146 @@ func getValidFileName(defaultFileName string) (string, error) {
 	return "", fmt.Errorf("No valid input file found")
 }
 
+// getSystemState reads the system state, the parts that cannot be read are reported as warnings.
+// Without allowPartial a partial state is an error: changes made from it would install the
+// applications and add the remotes that could not be read again.
+func getSystemState(allowPartial bool) model.State {
+	systemState, err := state.GetSystemState(context.Background())
+	var partial *state.PartialStateError
+	if errors.As(err, &partial) {
+		for _, warning := range partial.Errors {
+			log.Printf("Warning: %v \n", warning)
+		}
+		if !allowPartial {
+			log.Fatalf("The system state is incomplete, use -allow-partial to change the system anyway: %v", err)
+		}
+	} else if err != nil {
+		log.Fatalf("Error reading the system state: %v \n", err)
+	}
+	return systemState
+}
+
+// getNixState reads the JSON rendering of a nix-flatpak configuration, given as [user:|system:]file.json.
+// The installation is the user one by default, the one managed by home-manager.
+func getNixState(spec string) (model.State, error) {
+	installationType := utility.UserInstallationType
+	for _, prefix := range []string{utility.UserInstallationType, utility.SystemInstallationType} {
+		if strings.HasPrefix(spec, prefix+":") {
+			installationType, spec = prefix, strings.TrimPrefix(spec, prefix+":")
+		}
+	}
+	return state.GetNixState(spec, installationType)
+}
+
+// getNextState reads the desired state from a compose file or, with the nix: prefix, from a nix-flatpak configuration
+func getNextState(fileName string) (model.State, error) {
+	if strings.HasPrefix(fileName, "nix:") {
+		return getNixState(strings.TrimPrefix(fileName, "nix:"))
+	}
+	file, err := getValidFileName(fileName)
+	if err != nil {
+		return model.State{}, fmt.Errorf("Compose file not found: %v \nYou should specify the input file or create a flatpak-compose.yml or flatpak-compose.yaml in the same directory.", err)
+	}
+	return state.GetFileState(file)
+}
+
+// isOfflineState reports whether the current state selected by the -current-state flag is read from a file
+func isOfflineState(stateType string) bool {
+	return strings.HasPrefix(stateType, "file:") || strings.HasPrefix(stateType, "nix:")
+}
+
+// getCurrentState returns the current state selected by the -current-state flag
+func getCurrentState(stateType string, nextState model.State, allowPartial bool) (model.State, error) {
+	if !isOfflineState(stateType) {
+		// The custom installations of the next state must exist on the system
+		if err := state.ValidateInstallations(nextState); err != nil {
+			return model.State{}, err
+		}
+	}
+	switch {
+	case stateType == "system-compose":
+		return state.GetSharedState(nextState, getSystemState(allowPartial)), nil
+	case stateType == "system":
+		return getSystemState(allowPartial), nil
+	case strings.HasPrefix(stateType, "file:"):
+		// A compose file or an exported state, no flatpak is needed
+		return state.GetFileState(strings.TrimPrefix(stateType, "file:"))
+	case strings.HasPrefix(stateType, "nix:"):
+		return getNixState(strings.TrimPrefix(stateType, "nix:"))
+	default:
+		return model.State{}, fmt.Errorf("Invalid current-state type. Use 'system-compose', 'system', 'file:<file.yaml>' or 'nix:<file.json>'.")
+	}
+}
+
+// getUpdates returns the updates of the applications with the always policy. The plan is still
+// made without them when the remotes cannot be queried, e.g. on a machine without network.
+func getUpdates(currentState, nextState model.State) []state.Update {
+	updates, err := state.GetUpdates(currentState, nextState, model.UpdatePolicyAlways)
+	if err != nil {
+		log.Printf("Warning: updates are left out of the plan: %v \n", err)
+		return nil
+	}
+	return updates
+}
+
+// getPrunes returns the prune operations of the removed applications. The plan is still made without
+// the list of unused runtimes when it cannot be computed, flatpak finds them again when pruning.
+func getPrunes(removedApps []model.FlatpakApplication, preview bool) []state.Prune {
+	prunes, err := state.GetPrunes(removedApps, preview)
+	if err != nil {
+		log.Printf("Warning: the unused runtimes are left out of the plan: %v \n", err)
+		prunes, _ = state.GetPrunes(removedApps, false)
+	}
+	return prunes
+}
+
+// checkDestructiveChanges stops when the diff removes protected items or too many applications
+func checkDestructiveChanges(diff state.DiffState, currentState, nextState model.State, allowDestroy bool) {
+	if allowDestroy {
+		return
+	}
+	// Items removed from the compose file stay protected until the next apply
+	lastApplied, _ := state.GetLastAppliedState()
+	if err := state.CheckDestructiveChanges(diff, currentState, nextState, lastApplied); err != nil {
+		log.Fatalf("The plan contains destructive changes, use -allow-destroy to run it anyway:\n%v \n", err)
+	}
+}
+
 func main() {
 	applyCmd := flag.NewFlagSet("apply", flag.ExitOnError)
-	applyFile := applyCmd.String("f", "flatpak-compose.yaml", "YAML file for applying changes")
-	applyNextState := applyCmd.String("current-state", "system-compose", "Specify the current state type: system-compose or system")
+	applyFile := applyCmd.String("f", "flatpak-compose.yaml", "YAML file for applying changes, or nix:[user:|system:]<file.json> for a nix-flatpak configuration")
+	applyNextState := applyCmd.String("current-state", "system-compose", "Specify the current state type: system-compose, system, file:<file.yaml> or nix:<file.json>")
 	applyAssumeyes := applyCmd.Bool("assumeyes", false, "Automatically answer yes for all questions")
+	applyPrune := applyCmd.Bool("prune", false, "Remove the runtimes that are no longer used after applications are removed")
+	applyRollback := applyCmd.Bool("rollback", false, "Stop at the first failed command and revert the completed changes")
+	applyAllowDestroy := applyCmd.Bool("allow-destroy", false, "Allow the removal of protected items, of remotes in use and of more applications than the guard limit")
+	applyAllowPartial := applyCmd.Bool("allow-partial", false, "Apply changes even if parts of the system state cannot be read")
 
 	planCmd := flag.NewFlagSet("plan", flag.ExitOnError)
-	planFile := planCmd.String("f", "flatpak-compose.yaml", "YAML file for planning changes")
-	planNextState := planCmd.String("current-state", "system-compose", "Specify the current state type: system-compose or system")
+	planFile := planCmd.String("f", "flatpak-compose.yaml", "YAML file for planning changes, or nix:[user:|system:]<file.json> for a nix-flatpak configuration")
+	planNextState := planCmd.String("current-state", "system-compose", "Specify the current state type: system-compose, system, file:<file.yaml> or nix:<file.json>")
+	planPrune := planCmd.Bool("prune", false, "Remove the runtimes that are no longer used after applications are removed")
+	planRoot := planCmd.String("root", "", "Read the system state from an alternate tree, such as a mounted image or a chroot")
+	planFormat := planCmd.String("format", "text", "Output format: text, sh (standalone shell script) or ansible (playbook)")
+	planAllowDestroy := planCmd.Bool("allow-destroy", false, "Allow the removal of protected items, of remotes in use and of more applications than the guard limit")
+
+	updateCmd := flag.NewFlagSet("update", flag.ExitOnError)
+	updateFile := updateCmd.String("f", "flatpak-compose.yaml", "YAML file for updating applications")
+	updateAssumeyes := updateCmd.Bool("assumeyes", false, "Automatically answer yes for all questions")
+	updateDryRun := updateCmd.Bool("dry-run", false, "Only show the update commands")
+	updateAllowPartial := updateCmd.Bool("allow-partial", false, "Update applications even if parts of the system state cannot be read")
+
+	driftCmd := flag.NewFlagSet("drift", flag.ExitOnError)
+	driftFile := driftCmd.String("f", "flatpak-compose.yaml", "YAML file for detecting drift")
+	driftRoot := driftCmd.String("root", "", "Read the system state from an alternate tree, such as a mounted image or a chroot")
 
 	exportCmd := flag.NewFlagSet("export-state", flag.ExitOnError)
 	exportFile := exportCmd.String("f", "flatpak-compose.yaml", "YAML file for exporting state")
+	exportRoot := exportCmd.String("root", "", "Read the system state from an alternate tree, such as a mounted image or a chroot")
+	exportFormat := exportCmd.String("format", "yaml", "Output format: yaml, ansible (playbook) or nix (nix-flatpak module)")
+	exportInstallation := exportCmd.String("installation", "user", "Installation exported with -format=nix: user (home-manager) or system (NixOS)")
+	exportDetails := exportCmd.Bool("details", false, "Add the version, commit, arch, runtime, installed size, install date and end-of-life status of the applications")
+	exportGPGKeyDir := exportCmd.String("gpg-key-dir", "", "Write remote GPG keys as files in this directory and reference them with gpg-key-file")
 
 	if len(os.Args) < 2 {
 		printUsage()
@@ -50,75 +182,81 @@ func main() {
 	switch os.Args[1] {
 	case "apply":
 		applyCmd.Parse(os.Args[2:])
-		// Check if next-state is valid
-		if *applyNextState != "system-compose" && *applyNextState != "system" {
-			log.Fatalf("Invalid next-state type. Use 'system-compose' or 'system'.")
-			return
-		}
-
-		file, err := getValidFileName(*applyFile)
-		if err != nil {
-			log.Fatalf("Apply compose file not found: %v \n", err)
-			log.Fatalf("You should specify the input file or create a flatpak-compose.yml or flatpak-compose.yaml in the same directory. \n")
-			return
-		}
 
 		// Get next state
 		var currentState, nextState model.State
-		nextState, err = state.GetFileState(file)
+		nextState, err := getNextState(*applyFile)
 		if err != nil {
 			log.Fatalf("%v \n", err)
 			return
 		}
 
-		switch *applyNextState {
-		case "system-compose":
-			currentState = state.GetSharedState(nextState, state.GetSystemState())
-		case "system":
-			currentState = state.GetSystemState()
+		currentState, err = getCurrentState(*applyNextState, nextState, *applyAllowPartial)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
 		}
 
 		diff := state.GetDiffState(currentState, nextState)
+		// Updates of applications with the always policy need the system
+		if !isOfflineState(*applyNextState) {
+			diff.Updates = getUpdates(currentState, nextState)
+		}
+		if *applyPrune || nextState.Prune {
+			diff.Prunes = getPrunes(diff.AppsToRemove, !isOfflineState(*applyNextState))
+		}
+		checkDestructiveChanges(diff, currentState, nextState, *applyAllowDestroy)
 		if applyCmd.Parsed() {
 			if planCmd.Parsed() {
 				view.PrintDiffCommands(diff)
 			} else {
-				view.ExecDiffCommands(diff, *applyAssumeyes)
+				if view.ExecDiffCommands(diff, *applyAssumeyes, *applyRollback) {
+					// Remember the applied state for drift detection
+					if err := state.SaveLastAppliedState(nextState); err != nil {
+						log.Printf("Warning: cannot save the last applied state: %v \n", err)
+					}
+				}
 			}
 		}
 
 	case "plan":
 		planCmd.Parse(os.Args[2:])
-		// Check if next-state is valid
-		if *planNextState != "system-compose" && *planNextState != "system" {
-			log.Fatalf("Invalid next-state type. Use 'system-compose' or 'system'.")
-			return
-		}
-		// Get valid file
-		file, err := getValidFileName(*planFile)
-		if err != nil {
-			log.Fatalf("Plan compose file not found: %v \n", err)
-			log.Fatalf("You should specify the input file or create a flatpak-compose.yml or flatpak-compose.yaml in the same directory. \n")
-			return
-		}
+		utility.SetRoot(*planRoot)
 		// Get the respective states based on the flag value
 		var currentState, nextState model.State
 		// Get next state
-		nextState, err = state.GetFileState(file)
+		nextState, err := getNextState(*planFile)
 		if err != nil {
 			log.Fatalf("%v \n", err)
 			return
 		}
 
-		switch *planNextState {
-		case "system-compose":
-			currentState = state.GetSharedState(nextState, state.GetSystemState())
-		case "system":
-			currentState = state.GetSystemState()
+		currentState, err = getCurrentState(*planNextState, nextState, true)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
 		}
 
 		diff := state.GetDiffState(currentState, nextState)
-		view.PrintDiffCommands(diff)
+		// Updates of applications with the always policy need the running system
+		runningSystem := !isOfflineState(*planNextState) && *planRoot == ""
+		if runningSystem {
+			diff.Updates = getUpdates(currentState, nextState)
+		}
+		if *planPrune || nextState.Prune {
+			diff.Prunes = getPrunes(diff.AppsToRemove, runningSystem)
+		}
+		checkDestructiveChanges(diff, currentState, nextState, *planAllowDestroy)
+		switch *planFormat {
+		case "text":
+			view.PrintDiffCommands(diff)
+		case "sh":
+			view.PrintDiffScript(diff)
+		case "ansible":
+			view.PrintDiffPlaybook(diff)
+		default:
+			log.Fatalf("Invalid format '%s'. Use 'text', 'sh' or 'ansible'. \n", *planFormat)
+		}
 
 	case "export-state":
 		// Check if state-type is valid
@@ -127,6 +265,11 @@ func main() {
 			log.Fatal("Specify the state type to export: 'current-compose' or 'system'")
 		}
 		exportCmd.Parse(os.Args[3:])
+		utility.SetRoot(*exportRoot)
+		// nix-flatpak manages the user installation with home-manager and the system one with NixOS
+		if *exportInstallation != utility.UserInstallationType && *exportInstallation != utility.SystemInstallationType {
+			log.Fatalf("Invalid installation '%s'. Use 'user' or 'system'. \n", *exportInstallation)
+		}
 
 		exportStateType := os.Args[2]
 
@@ -147,19 +290,126 @@ func main() {
 				log.Fatalf("You should specify the input file or create a flatpak-compose.yml or flatpak-compose.yaml in the same directory. \n")
 				return
 			}
-			fmt.Println(file)
+			// The exported state is written on the standard output, the file name goes with the messages
+			fmt.Fprintln(os.Stderr, file)
 			fileState, err := state.GetFileState(file)
 			if err != nil {
 				log.Fatalf("%v \n", err)
 				return
 			}
-			exportState = state.GetSharedState(fileState, state.GetSystemState())
+			if err := state.ValidateInstallations(fileState); err != nil {
+				log.Fatalf("%v \n", err)
+				return
+			}
+			exportState = state.GetSharedState(fileState, getSystemState(true))
 		case "system":
-			exportState = state.GetSystemState()
+			exportState = getSystemState(true)
+		}
+		if *exportDetails {
+			if err := state.AddApplicationInfo(context.Background(), exportState.Applications); err != nil {
+				log.Printf("Warning: %v \n", err)
+			}
+		}
+		if *exportGPGKeyDir != "" {
+			if err := view.WriteGPGKeyFiles(&exportState, *exportGPGKeyDir); err != nil {
+				log.Fatalf("Error writing GPG key files: %v \n", err)
+				return
+			}
 		}
 		// Export the state to the file
-		// Replace this with the actual export logic
-		view.PrintState(exportState)
+		switch *exportFormat {
+		case "yaml":
+			view.PrintState(exportState)
+		case "ansible":
+			view.PrintStatePlaybook(exportState)
+		case "nix":
+			view.PrintStateNix(exportState, *exportInstallation)
+		default:
+			log.Fatalf("Invalid format '%s'. Use 'yaml', 'ansible' or 'nix'. \n", *exportFormat)
+		}
+
+	case "update":
+		updateCmd.Parse(os.Args[2:])
+		file, err := getValidFileName(*updateFile)
+		if err != nil {
+			log.Fatalf("Update compose file not found: %v \n", err)
+			return
+		}
+		nextState, err := state.GetFileState(file)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		if err := state.ValidateInstallations(nextState); err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		// Only the applications of the compose file are updated
+		currentState := state.GetSharedState(nextState, getSystemState(*updateAllowPartial || *updateDryRun))
+		updates, err := state.GetUpdates(currentState, nextState, model.UpdatePolicyAlways, model.UpdatePolicyManual, model.UpdatePolicySecurityOnly)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		diff := state.DiffState{Updates: updates}
+		if *updateDryRun {
+			view.PrintDiffCommands(diff)
+		} else {
+			view.ExecDiffCommands(diff, *updateAssumeyes, false)
+		}
+
+	case "drift":
+		driftCmd.Parse(os.Args[2:])
+		utility.SetRoot(*driftRoot)
+		file, err := getValidFileName(*driftFile)
+		if err != nil {
+			log.Fatalf("Drift compose file not found: %v \n", err)
+			return
+		}
+		desiredState, err := state.GetFileState(file)
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		if err := state.ValidateInstallations(desiredState); err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		lastAppliedState, err := state.GetLastAppliedState()
+		if err != nil {
+			log.Fatalf("%v \n", err)
+			return
+		}
+		actualState := getSystemState(true)
+		view.PrintDrift(state.GetDriftState(lastAppliedState, desiredState, actualState))
+		// Overrides of uninstalled applications are left behind by flatpak uninstall
+		orphaned, err := state.GetOrphanedOverrides(actualState.Applications)
+		if err != nil {
+			log.Printf("Warning: cannot list the override files: %v \n", err)
+		}
+		view.PrintOrphanedOverrides(orphaned)
+
+	case "permissions":
+		if len(os.Args) < 3 {
+			log.Fatal("Specify the application id")
+		}
+		appID := os.Args[2]
+
+		systemState := getSystemState(true)
+		globalSystem, globalUser, err := state.GetGlobalOverrides(context.Background())
+		if err != nil {
+			log.Printf("Warning: %v \n", err)
+		}
+		found := false
+		for _, app := range systemState.Applications {
+			if app.Name == appID {
+				view.PrintEffectivePermissions(app, state.GetEffectivePermissions(app, globalSystem, globalUser))
+				found = true
+			}
+		}
+		if !found {
+			log.Fatalf("Application %s is not installed \n", appID)
+		}
 	case "help":
 		printUsage()
 
@@ -174,19 +424,34 @@ func printUsage() {
 	fmt.Println("The tool performs the difference between the current state and the desired state (the one described in the file). The current state can be the system state or the intersection between the system and desired state (system-compose).")
 	fmt.Println("The user can choose the current state. The current state is the system-compose state by default in order to avoid unwanted changes.")
 	fmt.Println("\nUsage:")
-	fmt.Println("flatpak-compose apply [-f file.yaml] [-current-state=system/system-compose]     # Apply changes based on the difference between the current state and the desired state (compose state)")
-	fmt.Println("flatpak-compose plan [-f file.yaml] [-current-state=system/system-compose]      # Show changes based on the difference between the current state and the desired state (compose state)")
-	fmt.Println("flatpak-compose export-state [-f file.yaml] system/system-compose   # Show the system or system-compose state using the YAML format")
+	fmt.Println("flatpak-compose apply [-f file.yaml/nix:flatpak.json] [-current-state=system/system-compose/file:old.yaml/nix:flatpak.json] [-prune] [-rollback] [-allow-destroy] [-allow-partial]     # Apply changes based on the difference between the current state and the desired state (compose state)")
+	fmt.Println("flatpak-compose plan [-f file.yaml/nix:flatpak.json] [-current-state=system/system-compose/file:old.yaml/nix:flatpak.json] [-prune] [-allow-destroy] [-root=dir] [-format=text/sh/ansible]     # Show changes based on the difference between the current state and the desired state (compose state)")
+	fmt.Println("flatpak-compose export-state system/system-compose [-f file.yaml] [-gpg-key-dir=dir] [-root=dir] [-details] [-format=yaml/ansible/nix] [-installation=user/system]   # Show the system or system-compose state using the YAML format")
+	fmt.Println("flatpak-compose update [-f file.yaml] [-assumeyes] [-dry-run] [-allow-partial]     # Update the applications of the compose file according to their update policy")
+	fmt.Println("flatpak-compose drift [-f file.yaml] [-root=dir]      # Compare the last applied state, the compose state and the system state")
+	fmt.Println("flatpak-compose permissions <app-id>      # Show the effective sandbox permissions of an installed application")
 	fmt.Println("\nOptions:")
 	fmt.Println("  apply         : Apply changes based on the difference between the current state and the desired state (compose state)")
 	fmt.Println("  plan          : Show changes based on the difference between the current state and the desired state (compose state)")
 	fmt.Println("  export-state  : Show the current state, can be either the system or system-compose state using the YAML format")
+	fmt.Println("  update        : Update the applications of the compose file, unmanaged applications are left alone")
+	fmt.Println("  drift         : Show what changed since the last apply, on the system (manual) or in the compose file (compose)")
+	fmt.Println("  permissions   : Show the effective sandbox of an application and the layer (metadata, global, system or user overrides) that set each permission")
 	fmt.Println("  help          : Show usage information")
 	fmt.Println("\nFlags:")
 	fmt.Println("  -f                : YAML file to load (default: flatpak-compose.yaml)")
-	fmt.Println("  -current-state    : Specify the current state type (system/system-compose)")
+	fmt.Println("  -current-state    : Specify the current state type (system/system-compose/file:old.yaml)")
+	fmt.Println("  -prune            : Remove the runtimes that are no longer used after applications are removed")
+	fmt.Println("  -rollback         : Stop at the first failed command and revert the completed changes (apply only)")
+	fmt.Println("  -allow-destroy    : Allow plans removing protected items, remotes in use or more applications than guard.max_removals")
+	fmt.Println("  -allow-partial    : Change the system even if parts of its state cannot be read (apply, update)")
+	fmt.Println("  -gpg-key-dir      : Directory where export-state writes the remote GPG keys (referenced with gpg-key-file)")
+	fmt.Println("  -details          : Add an info block with the version, commit, arch, runtime, size, install date and end-of-life status of the applications (export-state)")
+	fmt.Println("  -format           : Output format of plan: text (default), sh (standalone POSIX shell script) or ansible (playbook); of export-state: yaml (default), ansible or nix")
+	fmt.Println("  -installation     : Installation exported with -format=nix: user (default, home-manager) or system (NixOS)")
+	fmt.Println("  -root             : Read the system state from an alternate tree, such as a mounted image or a chroot (plan, export-state, drift)")
 	fmt.Println("\nExplanation:")
-	fmt.Println("  current state     : Can be the system or system-compose state")
+	fmt.Println("  current state     : Can be the system or system-compose state, or a state read from a file")
 	fmt.Println("  system state      : Includes all the applications/repos in the system")
 	fmt.Println("  compose state      : The desired state described by the yaml file")
 	fmt.Println("  system-compose state: Includes all the application/repos that are in common between the compose state and the system state (right join)")
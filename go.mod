@@ -2,4 +2,4 @@ module github.com/faan11/flatpak-compose
 
 go 1.21.4
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,380 @@
+// Package keyfile reads and writes key files in the GKeyFile format used by flatpak:
+// the repo config, application metadata, overrides, installations.d files and
+// .flatpakrepo/.flatpakref files.
+package keyfile
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyFile is a parsed key file. Comments, blank lines and the order of the groups and
+// keys are kept, so that an unmodified file is written back unchanged.
+type KeyFile struct {
+	header []string // Comments and blank lines before the first group
+	groups []*group
+}
+
+type group struct {
+	name    string
+	entries []entry
+}
+
+// entry is a line of a group, comments and blank lines have no key
+type entry struct {
+	key   string // Key with its locale, e.g. Name[de]
+	value string // Escaped value
+	raw   string // Line as read, empty once the value is changed
+}
+
+// isBlank reports whether the entry is a blank line
+func (e entry) isBlank() bool {
+	return e.key == "" && strings.TrimSpace(e.raw) == ""
+}
+
+// New returns an empty key file
+func New() *KeyFile {
+	return &KeyFile{}
+}
+
+// ReadFile reads and parses a key file
+func ReadFile(path string) (*KeyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return k, nil
+}
+
+// Parse parses the content of a key file
+func Parse(data []byte) (*KeyFile, error) {
+	k := New()
+	if len(data) == 0 {
+		return k, nil
+	}
+	var current *group
+	for i, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#"):
+			if current == nil {
+				k.header = append(k.header, line)
+			} else {
+				current.entries = append(current.entries, entry{raw: line})
+			}
+		case strings.HasPrefix(trimmed, "["):
+			// The group name is everything up to the last bracket, e.g. [remote "flathub"]
+			end := strings.LastIndex(trimmed, "]")
+			if end == -1 || strings.TrimSpace(trimmed[end+1:]) != "" {
+				return nil, fmt.Errorf("line %d: invalid group header: %s", i+1, line)
+			}
+			name := trimmed[1:end]
+			if name == "" || strings.ContainsAny(name, "[]") {
+				return nil, fmt.Errorf("line %d: invalid group name: %s", i+1, name)
+			}
+			// Keys of a repeated group are merged into the first one
+			if current = k.group(name); current == nil {
+				current = &group{name: name}
+				k.groups = append(k.groups, current)
+			}
+		default:
+			if current == nil {
+				return nil, fmt.Errorf("line %d: key file does not start with a group", i+1)
+			}
+			parts := strings.SplitN(trimmed, "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("line %d: malformed line: %s", i+1, line)
+			}
+			key := strings.TrimRight(parts[0], " \t")
+			if key == "" {
+				return nil, fmt.Errorf("line %d: empty key", i+1)
+			}
+			// A later value of the same key replaces the earlier one
+			value := strings.TrimLeft(parts[1], " \t")
+			if index := current.index(key); index != -1 {
+				current.entries[index] = entry{key: key, value: value}
+			} else {
+				current.entries = append(current.entries, entry{key: key, value: value, raw: line})
+			}
+		}
+	}
+	return k, nil
+}
+
+func (k *KeyFile) group(name string) *group {
+	for _, g := range k.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+func (g *group) index(key string) int {
+	for i, e := range g.entries {
+		if e.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Groups returns the group names in file order
+func (k *KeyFile) Groups() []string {
+	var names []string
+	for _, g := range k.groups {
+		names = append(names, g.name)
+	}
+	return names
+}
+
+// HasGroup reports whether the group exists
+func (k *KeyFile) HasGroup(name string) bool {
+	return k.group(name) != nil
+}
+
+// Keys returns the keys of a group in file order, localized keys included
+func (k *KeyFile) Keys(groupName string) []string {
+	var keys []string
+	if g := k.group(groupName); g != nil {
+		for _, e := range g.entries {
+			if e.key != "" {
+				keys = append(keys, e.key)
+			}
+		}
+	}
+	return keys
+}
+
+// Value returns the escaped value of a key
+func (k *KeyFile) Value(groupName, key string) (string, bool) {
+	g := k.group(groupName)
+	if g == nil {
+		return "", false
+	}
+	if i := g.index(key); i != -1 {
+		return g.entries[i].value, true
+	}
+	return "", false
+}
+
+// String returns the unescaped value of a key
+func (k *KeyFile) String(groupName, key string) (string, bool) {
+	value, ok := k.Value(groupName, key)
+	if !ok {
+		return "", false
+	}
+	return unescape(value, false), true
+}
+
+// LocaleString returns the value of a key for a locale such as de_DE.UTF-8@euro,
+// falling back to less specific locales and then to the unlocalized key
+func (k *KeyFile) LocaleString(groupName, key, locale string) (string, bool) {
+	for _, candidate := range localeVariants(locale) {
+		if value, ok := k.String(groupName, key+"["+candidate+"]"); ok {
+			return value, true
+		}
+	}
+	return k.String(groupName, key)
+}
+
+// localeVariants returns the locale names to try, from the most specific one: lang_COUNTRY@MODIFIER,
+// lang_COUNTRY, lang@MODIFIER and lang. The encoding is ignored.
+func localeVariants(locale string) []string {
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return nil
+	}
+	modifier := ""
+	if i := strings.Index(locale, "@"); i != -1 {
+		locale, modifier = locale[:i], locale[i:]
+	}
+	if i := strings.Index(locale, "."); i != -1 {
+		locale = locale[:i]
+	}
+	lang, country := locale, ""
+	if i := strings.Index(locale, "_"); i != -1 {
+		lang, country = locale[:i], locale[i:]
+	}
+	var variants []string
+	if country != "" && modifier != "" {
+		variants = append(variants, lang+country+modifier)
+	}
+	if country != "" {
+		variants = append(variants, lang+country)
+	}
+	if modifier != "" {
+		variants = append(variants, lang+modifier)
+	}
+	return append(variants, lang)
+}
+
+// StringList returns the values of a list key, separated by semicolons. Escaped semicolons
+// are part of the values and the trailing separator is optional.
+func (k *KeyFile) StringList(groupName, key string) ([]string, bool) {
+	value, ok := k.Value(groupName, key)
+	if !ok {
+		return nil, false
+	}
+	values := []string{}
+	current := ""
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value):
+			current += value[i : i+2]
+			i++
+		case value[i] == ';':
+			values = append(values, unescape(current, true))
+			current = ""
+		default:
+			current += string(value[i])
+		}
+	}
+	if current != "" {
+		values = append(values, unescape(current, true))
+	}
+	return values, true
+}
+
+// Set sets the value of a key, escaping it. The group is created when missing.
+func (k *KeyFile) Set(groupName, key, value string) {
+	k.setValue(groupName, key, escape(value, false))
+}
+
+// SetStringList sets the values of a list key
+func (k *KeyFile) SetStringList(groupName, key string, values []string) {
+	value := ""
+	for _, v := range values {
+		value += escape(v, true) + ";"
+	}
+	k.setValue(groupName, key, value)
+}
+
+// setValue sets the escaped value of a key, new keys are added after the last key of the group
+func (k *KeyFile) setValue(groupName, key, value string) {
+	g := k.group(groupName)
+	if g == nil {
+		// Groups are separated by a blank line
+		if len(k.groups) > 0 {
+			last := k.groups[len(k.groups)-1]
+			if len(last.entries) == 0 || !last.entries[len(last.entries)-1].isBlank() {
+				last.entries = append(last.entries, entry{})
+			}
+		}
+		g = &group{name: groupName}
+		k.groups = append(k.groups, g)
+	}
+	if i := g.index(key); i != -1 {
+		g.entries[i] = entry{key: key, value: value}
+		return
+	}
+	position := len(g.entries)
+	for position > 0 && g.entries[position-1].key == "" {
+		position--
+	}
+	g.entries = append(g.entries, entry{})
+	copy(g.entries[position+1:], g.entries[position:])
+	g.entries[position] = entry{key: key, value: value}
+}
+
+// Delete removes a key
+func (k *KeyFile) Delete(groupName, key string) {
+	if g := k.group(groupName); g != nil {
+		if i := g.index(key); i != -1 {
+			g.entries = append(g.entries[:i], g.entries[i+1:]...)
+		}
+	}
+}
+
+// DeleteGroup removes a group and its keys
+func (k *KeyFile) DeleteGroup(groupName string) {
+	for i, g := range k.groups {
+		if g.name == groupName {
+			k.groups = append(k.groups[:i], k.groups[i+1:]...)
+			return
+		}
+	}
+}
+
+// Bytes serializes the key file
+func (k *KeyFile) Bytes() []byte {
+	var b strings.Builder
+	for _, line := range k.header {
+		b.WriteString(line + "\n")
+	}
+	for _, g := range k.groups {
+		b.WriteString("[" + g.name + "]\n")
+		for _, e := range g.entries {
+			if e.key == "" || e.raw != "" {
+				b.WriteString(e.raw + "\n")
+			} else {
+				b.WriteString(e.key + "=" + e.value + "\n")
+			}
+		}
+	}
+	return []byte(b.String())
+}
+
+// escape escapes a value: backslashes, control characters and a leading space,
+// and the semicolons of list values
+func escape(value string, list bool) string {
+	var b strings.Builder
+	for i, c := range value {
+		switch {
+		case c == ' ' && i == 0:
+			b.WriteString(`\s`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c == ';' && list:
+			b.WriteString(`\;`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// unescape reverses escape, unknown escape sequences are kept as they are
+func unescape(value string, list bool) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 's':
+			b.WriteByte(' ')
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '\\':
+			b.WriteByte('\\')
+		case ';':
+			if list {
+				b.WriteByte(';')
+			} else {
+				b.WriteString(`\;`)
+			}
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
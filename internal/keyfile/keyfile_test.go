@@ -0,0 +1,218 @@
+package keyfile
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	files := map[string]string{
+		"repo config": `# Written by flatpak
+[core]
+repo_version=1
+mode=bare-user-only
+xa.masked=org.example.App;
+
+[remote "flathub"]
+url=https://dl.flathub.org/repo/
+gpg-verify=true
+xa.title=Flathub
+`,
+		"metadata": `[Application]
+name=org.gnome.Calculator
+runtime=org.gnome.Platform/x86_64/46
+
+[Context]
+shared=network;ipc;
+sockets=x11;wayland;!fallback-x11;
+filesystems=xdg-run/dconf;~/.config/dconf:ro;
+
+[Session Bus Policy]
+ca.desrt.dconf=talk
+`,
+		"localized keys": `[Flatpak Ref]
+Title=Calculator
+Title[de]=Rechner
+Comment=  spaces kept as written
+`,
+		"comments in groups": `[Context]
+# Granted by the user
+shared=network;
+
+# Unset
+sockets=!x11;
+`,
+	}
+	for name, data := range files {
+		k, err := Parse([]byte(data))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := string(k.Bytes()); got != data {
+			t.Errorf("%s: written back as\n%s\nwant\n%s", name, got, data)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	invalid := map[string]string{
+		"key before group": "key=value\n",
+		"unclosed group":   "[Context\nshared=network;\n",
+		"empty group":      "[]\n",
+		"bracket in group": "[a]b]\n",
+		"line without =":   "[Context]\nshared\n",
+		"empty key":        "[Context]\n=network\n",
+	}
+	for name, data := range invalid {
+		if _, err := Parse([]byte(data)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	values := []string{
+		"plain",
+		" leading space",
+		"trailing space ",
+		"line\nbreak",
+		"tab\tand\rreturn",
+		`back\slash`,
+		"semi;colon",
+		"",
+	}
+	for _, value := range values {
+		k := New()
+		k.Set("Group", "key", value)
+		parsed, err := Parse(k.Bytes())
+		if err != nil {
+			t.Fatalf("%q: %v", value, err)
+		}
+		if got, _ := parsed.String("Group", "key"); got != value {
+			t.Errorf("%q read back as %q", value, got)
+		}
+	}
+
+	k, _ := Parse([]byte("[Group]\nspace=\\sa\nunknown=\\x\nsemicolon=a\\;b\n"))
+	for key, want := range map[string]string{"space": " a", "unknown": `\x`, "semicolon": `a\;b`} {
+		if got, _ := k.String("Group", key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []string
+	}{
+		{"network;ipc;", []string{"network", "ipc"}},
+		{"network;ipc", []string{"network", "ipc"}},
+		{`a\;b;c;`, []string{"a;b", "c"}},
+		{`a\\;b;`, []string{`a\`, "b"}},
+		{"!x11;wayland;", []string{"!x11", "wayland"}},
+		{"", []string{}},
+	}
+	for _, test := range tests {
+		k, err := Parse([]byte("[Context]\nkey=" + test.value + "\n"))
+		if err != nil {
+			t.Fatalf("%q: %v", test.value, err)
+		}
+		got, ok := k.StringList("Context", "key")
+		if !ok || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.value, got, test.want)
+		}
+
+		// Lists are written back with a trailing separator
+		written := New()
+		written.SetStringList("Context", "key", test.want)
+		if got, _ := written.StringList("Context", "key"); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: written list read back as %q", test.value, got)
+		}
+	}
+	if _, ok := New().StringList("Context", "missing"); ok {
+		t.Error("missing key found")
+	}
+}
+
+func TestLocaleString(t *testing.T) {
+	k, err := Parse([]byte(`[Flatpak Ref]
+Title=Calculator
+Title[de]=Rechner
+Title[de_AT]=Rechner (AT)
+Title[sr@latin]=Kalkulator
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := map[string]string{
+		"de_AT.UTF-8": "Rechner (AT)",
+		"de_DE.UTF-8": "Rechner",
+		"de_DE@euro":  "Rechner",
+		"sr_RS@latin": "Kalkulator",
+		"fr_FR.UTF-8": "Calculator",
+		"C":           "Calculator",
+		"":            "Calculator",
+	}
+	for locale, want := range tests {
+		if got, _ := k.LocaleString("Flatpak Ref", "Title", locale); got != want {
+			t.Errorf("%q: got %q, want %q", locale, got, want)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	k, err := Parse([]byte(`[core]
+repo_version=1
+
+[remote "flathub"]
+url=https://dl.flathub.org/repo/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.Set("core", "xa.masked", "org.example.App")
+	k.Set(`remote "flathub"`, "url", "https://example.org/repo/")
+	k.Set(`remote "beta"`, "url", "https://example.org/beta/")
+	k.Delete(`remote "flathub"`, "missing")
+
+	// New keys go after the last key of the group, before the blank line
+	want := `[core]
+repo_version=1
+xa.masked=org.example.App
+
+[remote "flathub"]
+url=https://example.org/repo/
+
+[remote "beta"]
+url=https://example.org/beta/
+`
+	if got := string(k.Bytes()); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	k.DeleteGroup(`remote "beta"`)
+	k.Delete("core", "xa.masked")
+	if k.HasGroup(`remote "beta"`) {
+		t.Error("deleted group still exists")
+	}
+	if _, ok := k.Value("core", "xa.masked"); ok {
+		t.Error("deleted key still exists")
+	}
+}
+
+func TestRepeatedKeysAndGroups(t *testing.T) {
+	k, err := Parse([]byte("[Context]\nshared=network;\n[Context]\nsockets=x11;\nshared=ipc;\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups := k.Groups(); !reflect.DeepEqual(groups, []string{"Context"}) {
+		t.Errorf("groups: %q", groups)
+	}
+	if keys := k.Keys("Context"); !reflect.DeepEqual(keys, []string{"shared", "sockets"}) {
+		t.Errorf("keys: %q", keys)
+	}
+	if value, _ := k.String("Context", "shared"); value != "ipc;" {
+		t.Errorf("the last value is kept, got %q", value)
+	}
+}
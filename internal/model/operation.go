@@ -0,0 +1,65 @@
+package model
+
+import "strings"
+
+// OperationKind is the type of a step of a plan
+type OperationKind string
+
+const (
+	OperationRemoteDelete     OperationKind = "remote-delete"
+	OperationRemoteAdd        OperationKind = "remote-add"
+	OperationRemoteModify     OperationKind = "remote-modify"
+	OperationUninstall        OperationKind = "uninstall"
+	OperationInstall          OperationKind = "install"
+	OperationOverride         OperationKind = "override"
+	OperationOverrideReset    OperationKind = "override-reset"
+	OperationPermissionRemove OperationKind = "permission-remove"
+	OperationPermissionSet    OperationKind = "permission-set"
+	OperationMask             OperationKind = "mask"
+	OperationUnmask           OperationKind = "unmask"
+	OperationUpdate           OperationKind = "update"
+	OperationPrune            OperationKind = "prune"
+)
+
+// OperationFile is a file written before running an operation, such as a .flatpakrepo file.
+// Arguments refer to it with FilePlaceholder(Name).
+type OperationFile struct {
+	Name string
+	Data []byte
+}
+
+// Operation is a step of a plan
+type Operation struct {
+	ID           string        // Unique identifier used by the dependencies
+	Kind         OperationKind
+	Target       string        // Remote, application or ref the operation acts on
+	Remote       string        // Remote providing the application of installs and uninstalls
+	Installation string        // Installation type
+	Args         []string      // Command line, Args[0] is the program
+	Files        []OperationFile
+	Comment      string        // Description shown in the plan
+	DependsOn    []string      // Operations that must complete before this one
+	Revert       *Operation    // Operation undoing this one, nil when it is not reversible
+}
+
+// Reversible reports whether the operation can be rolled back
+func (o Operation) Reversible() bool {
+	return o.Revert != nil
+}
+
+// FilePlaceholder returns the placeholder used in arguments for the path of an operation file
+func FilePlaceholder(name string) string {
+	return "{{" + name + "}}"
+}
+
+// ResolveArgs replaces the file placeholders in the arguments with the given paths
+func (o Operation) ResolveArgs(path func(file OperationFile) string) []string {
+	args := make([]string, len(o.Args))
+	for i, arg := range o.Args {
+		for _, file := range o.Files {
+			arg = strings.ReplaceAll(arg, FilePlaceholder(file.Name), path(file))
+		}
+		args[i] = arg
+	}
+	return args
+}
@@ -1,10 +1,25 @@
 package model
 
+import (
+	"strconv"
+	"strings"
+)
+
+// Remote keys with a special meaning in the compose file
+const (
+	RemoteGPGKey     = "GPGKey"       // Base64 encoded keyring
+	RemoteGPGKeyFile = "gpg-key-file" // Path of a .gpg/.asc key file, relative to the compose file
+	RemoteFrom       = "from"         // Path of a .flatpakrepo file, relative to the compose file
+	RemoteProtect    = "protect"      // The remote cannot be removed without --allow-destroy
+	RemoteFromURL    = "from-url"     // URL of a .flatpakrepo file, read by flatpak remote-add when the remote is added
+)
+
 // Environment has core + remotes of an installation type
 type Environment struct {
 	Core    map[string]string		`yaml:"core"`
 	Remotes map[string]map[string]string	`yaml:"remotes"`
 	InstallationType string 		`yaml:"type"`
+	Protected []string			`yaml:"protected,omitempty"` // Remotes declared with protect: true
 }
 
 type Permission struct {
@@ -14,20 +29,72 @@ type Permission struct {
 	Data		string		`yaml:"data"`
 }
 
+// Application sources, the default source is a remote: an empty source is a remote source
+const (
+	SourceRemote     = "remote"
+	SourceBundle     = "bundle"     // Single-file bundle installed with flatpak install --bundle
+	SourceFlatpakRef = "flatpakref" // .flatpakref file installed with flatpak install --from
+)
+
+// Override modes
+const (
+	OverrideModeMerge = "merge" // Declared overrides are added to the existing ones (default)
+	OverrideModeExact = "exact" // Overrides are reset and made equal to the declared ones
+)
+
+// Update policies
+const (
+	UpdatePolicyAlways       = "always"        // Updated by apply and by the update command
+	UpdatePolicyManual       = "manual"        // Updated only by the update command (default)
+	UpdatePolicyNever        = "never"         // Never updated, the application is masked
+	UpdatePolicySecurityOnly = "security-only" // The application is masked, only its runtime is updated
+)
+
 type FlatpakApplication struct {
 	Name             string   	`yaml:"name"`  
 	Repo             string   	`yaml:"repo"`
+	Source           string   	`yaml:"source,omitempty"` // remote (default), bundle or flatpakref
+	Path             string   	`yaml:"path,omitempty"`   // Local file of bundle and flatpakref sources
 	Branch           string   	`yaml:"branch,omitempty"`
 	All              []string 	`yaml:"all"`            // Default permissions
 	Overrides        []string 	`yaml:"overrides"`      // Override permissions
 	OverridesUser    []string 	`yaml:"overrides_user"` // Override user permissions
+	OverrideMode     string   	`yaml:"override_mode,omitempty"` // merge (default) or exact
+	UpdatePolicy     string   	`yaml:"update_policy,omitempty"` // always, manual (default), never or security-only
+	Masked           bool     	`yaml:"-"`                       // Updates are masked (flatpak mask), from the update policy in compose files
 	InstallationType string   	`yaml:"type"`
 	Permissions	 []Permission	`yaml:"permissions"`
+	Protect          bool     	`yaml:"protect,omitempty"`       // The application cannot be removed without --allow-destroy
+	Info             *ApplicationInfo	`yaml:"info,omitempty"`    // Exported with --details, never diffed
+}
+
+// ApplicationInfo describes the deployed version of an application, for inventory reports
+type ApplicationInfo struct {
+	Version       string `yaml:"version,omitempty"`
+	Commit        string `yaml:"commit,omitempty"`
+	Arch          string `yaml:"arch,omitempty"`
+	Runtime       string `yaml:"runtime,omitempty"`        // Runtime ref, e.g. org.freedesktop.Platform/x86_64/23.08
+	InstalledSize uint64 `yaml:"installed_size,omitempty"` // Bytes
+	InstallDate   string `yaml:"install_date,omitempty"`   // RFC 3339
+	EOL           string `yaml:"eol,omitempty"`            // End-of-life message of the branch
+	EOLRebase     string `yaml:"eol_rebase,omitempty"`     // Application replacing an end-of-life one
+}
+
+// DefaultMaxRemovals is the number of applications a plan can remove without --allow-destroy
+const DefaultMaxRemovals = 5
+
+// Guard limits the destructive changes of a plan
+type Guard struct {
+	MaxRemovals *int `yaml:"max_removals,omitempty"` // Default DefaultMaxRemovals, 0 forbids removals, a negative value disables the limit
 }
 
 type State struct {
 	Environment  []Environment 	  `yaml:"envs"`
 	Applications []FlatpakApplication `yaml:"applications"`
+	OverrideMode string               `yaml:"override_mode,omitempty"` // Default override mode of the applications
+	UpdatePolicy string               `yaml:"update_policy,omitempty"` // Default update policy of the applications
+	Prune        bool                 `yaml:"prune,omitempty"`         // Remove unused runtimes after applications are removed
+	Guard        Guard                `yaml:"guard,omitempty"`
 }
 
 
@@ -39,3 +106,64 @@ func (e Environment) RemoteExists(installationType string, remoteName string) bo
 		return false;
 	}
 }
+
+// IsProtected reports whether the remote was declared with protect: true
+func (e Environment) IsProtected(remoteName string) bool {
+	for _, name := range e.Protected {
+		if name == remoteName {
+			return true
+		}
+	}
+	return false
+}
+
+// RemovalLimit returns the maximum number of applications removed by a plan, -1 when there is no limit
+func (g Guard) RemovalLimit() int {
+	switch {
+	case g.MaxRemovals == nil:
+		return DefaultMaxRemovals
+	case *g.MaxRemovals < 0:
+		return -1
+	}
+	return *g.MaxRemovals
+}
+
+// IsLocalSource reports whether the application is installed from a local file instead of a remote
+func (a FlatpakApplication) IsLocalSource() bool {
+	return a.Source == SourceBundle || a.Source == SourceFlatpakRef
+}
+
+// SameOrigin reports whether an installed origin belongs to the application.
+// Applications installed from local files get an origin remote created by flatpak,
+// named <id>-origin or <id>-<n>-origin when the name is already taken.
+func (a FlatpakApplication) SameOrigin(origin string) bool {
+	if a.Repo == origin {
+		return true
+	}
+	if !a.IsLocalSource() {
+		return false
+	}
+	if origin == a.Name+"-origin" {
+		return true
+	}
+	if !strings.HasPrefix(origin, a.Name+"-") || !strings.HasSuffix(origin, "-origin") {
+		return false
+	}
+	counter := strings.TrimSuffix(strings.TrimPrefix(origin, a.Name+"-"), "-origin")
+	_, err := strconv.Atoi(counter)
+	return err == nil
+}
+
+// IsMaskedPolicy reports whether the update policy requires the application to be masked
+func (a FlatpakApplication) IsMaskedPolicy() bool {
+	return a.UpdatePolicy == UpdatePolicyNever || a.UpdatePolicy == UpdatePolicySecurityOnly
+}
+
+// IsValidUpdatePolicy reports whether policy is a known update policy, empty means the default
+func IsValidUpdatePolicy(policy string) bool {
+	switch policy {
+	case "", UpdatePolicyAlways, UpdatePolicyManual, UpdatePolicyNever, UpdatePolicySecurityOnly:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// LastAppliedStatePath returns the file holding the compose state that was last applied successfully,
+// in the data directory of the user
+func LastAppliedStatePath() (string, error) {
+	dataHome, err := utility.UserDataDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot locate the last applied state: %w", err)
+	}
+	return filepath.Join(dataHome, "flatpak-compose", "last-applied.yaml"), nil
+}
+
+// SaveLastAppliedState stores the compose state after a successful apply
+func SaveLastAppliedState(appliedState model.State) error {
+	data, err := yaml.Marshal(appliedState)
+	if err != nil {
+		return err
+	}
+	path, err := LastAppliedStatePath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// GetLastAppliedState reads the compose state that was last applied successfully.
+// The stored state is already resolved, so it is not validated again like a compose file.
+func GetLastAppliedState() (model.State, error) {
+	var lastApplied model.State
+	path, err := LastAppliedStatePath()
+	if err != nil {
+		return lastApplied, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return lastApplied, fmt.Errorf("no state has been applied yet (%s not found)", path)
+		}
+		return lastApplied, err
+	}
+	err = yaml.Unmarshal(data, &lastApplied)
+	return lastApplied, err
+}
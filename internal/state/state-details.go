@@ -0,0 +1,132 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/faan11/flatpak-compose/internal/keyfile"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// AddApplicationInfo sets the Info of the installed applications from their deploy files,
+// or from flatpak list when they cannot be read. The applications without info are reported
+// with a *PartialStateError.
+func AddApplicationInfo(ctx context.Context, apps []model.FlatpakApplication) error {
+	var warnings []error
+
+	deployments := make(map[string]utility.Deployment)
+	installations, _ := utility.GetInstallations()
+	for _, installation := range installations {
+		installationDeployments, err := utility.GetDeployments(installation, utility.AppKind)
+		if err != nil {
+			continue
+		}
+		for _, deployment := range installationDeployments {
+			deployments[deploymentKey(deployment.Installation, deployment.ID, deployment.Branch)] = deployment
+		}
+	}
+
+	var missing []int
+	for i, app := range apps {
+		deployment, ok := deployments[deploymentKey(app.InstallationType, app.Name, app.Branch)]
+		if !ok {
+			missing = append(missing, i)
+			continue
+		}
+		info, err := readApplicationInfo(deployment)
+		if err != nil {
+			warnings = append(warnings, &SystemStateError{Part: PartMetadata, Target: deployment.Ref(), Err: err})
+			continue
+		}
+		apps[i].Info = &info
+	}
+
+	// The flatpak CLI only knows the running system
+	if len(missing) != 0 && utility.Root() == "" {
+		listed, err := getApplicationInfoFromCLI(ctx)
+		if err != nil {
+			warnings = append(warnings, &SystemStateError{Part: PartMetadata, Err: err})
+		}
+		var notListed []int
+		for _, i := range missing {
+			if info, ok := listed[deploymentKey(apps[i].InstallationType, apps[i].Name, apps[i].Branch)]; ok {
+				apps[i].Info = &info
+			} else if err == nil {
+				notListed = append(notListed, i)
+			}
+		}
+		missing = notListed
+	}
+	for _, i := range missing {
+		warnings = append(warnings, &SystemStateError{Part: PartMetadata, Target: apps[i].Name, Err: errNotDeployed})
+	}
+
+	if len(warnings) != 0 {
+		return &PartialStateError{Errors: warnings}
+	}
+	return nil
+}
+
+// errNotDeployed is reported for the applications whose deployment is not found
+var errNotDeployed = errors.New("deployment not found")
+
+// deploymentKey identifies an application deployed in an installation
+func deploymentKey(installationType, appID, branch string) string {
+	return installationType + "/" + appID + "/" + branch
+}
+
+// readApplicationInfo reads the info of an application from its deploy file and metadata.
+// The install date is the modification time of the active deployment.
+func readApplicationInfo(deployment utility.Deployment) (model.ApplicationInfo, error) {
+	deploy, err := deployment.ReadDeployData()
+	if err != nil {
+		return model.ApplicationInfo{}, err
+	}
+	info := model.ApplicationInfo{
+		Version:       deploy.MetadataString("appdata-version"),
+		Commit:        deploy.Commit,
+		Arch:          deployment.Arch,
+		InstalledSize: deploy.InstalledSize,
+		EOL:           deploy.MetadataString("eol"),
+		EOLRebase:     deploy.MetadataString("eolr"),
+	}
+	if metadata, err := deployment.ReadMetadata(); err == nil {
+		if k, err := keyfile.Parse([]byte(metadata)); err == nil {
+			info.Runtime, _ = k.String("Application", "runtime")
+		}
+	}
+	if stat, err := os.Stat(deployment.Dir); err == nil {
+		info.InstallDate = stat.ModTime().UTC().Format(time.RFC3339)
+	}
+	return info, nil
+}
+
+// getApplicationInfoFromCLI reads the info of the installed applications with flatpak list.
+// The installed size and the end-of-life status are not available.
+func getApplicationInfoFromCLI(ctx context.Context) (map[string]model.ApplicationInfo, error) {
+	output, err := exec.CommandContext(ctx, "flatpak", "list", "--app", "--columns=application,branch,installation,version,active,arch,runtime").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]model.ApplicationInfo)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			continue
+		}
+		key := deploymentKey(utility.ParseInstallationName(fields[2]), strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]))
+		infos[key] = model.ApplicationInfo{
+			Version: strings.TrimSpace(fields[3]),
+			Commit:  strings.TrimSpace(fields[4]),
+			Arch:    strings.TrimSpace(fields[5]),
+			Runtime: strings.TrimSpace(fields[6]),
+		}
+	}
+	return infos, nil
+}
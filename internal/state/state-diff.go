@@ -2,7 +2,9 @@ package state
 
 import (
 	"fmt"
+	"os"
 	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
 )
 
 type DiffState struct {
@@ -12,9 +14,22 @@ type DiffState struct {
 	AppsToAdd              []model.FlatpakApplication
 	AppsToRemove           []model.FlatpakApplication
 	PermToAdd 	       []model.FlatpakApplication
-	PermToRemove 	       []model.FlatpakApplication
 	DynamicPermToAdd       []model.FlatpakApplication
 	DynamicPermToRemove    []model.FlatpakApplication
+	OverridesToReset       []OverrideReset
+	MasksToAdd             []model.FlatpakApplication
+	MasksToRemove          []model.FlatpakApplication
+	Updates                []Update
+	Prunes                 []Prune
+}
+
+// OverrideReset makes the overrides of an application in a scope (system or user) equal to the declared ones
+type OverrideReset struct {
+	App     model.FlatpakApplication
+	Scope   string
+	Flags   []string // Declared overrides, applied after the reset
+	Added   []string // Effective change shown in the plan
+	Removed []string
 }
 
 type diffCore struct {
@@ -85,12 +100,18 @@ func compareEnvironments(prev, next []model.Environment) (toBeAdded, toBeRemoved
 		nextMap[env.InstallationType] = env
 	}
 
-	// Compare environments
-	for key, prevEnv := range prevMap {
-		nextEnv, exists := nextMap[key]
+	// Compare environments, in the order of the states so that the plan is stable
+	for _, prevEnv := range prev {
+		nextEnv, exists := nextMap[prevEnv.InstallationType]
 		if !exists {
-			// If prev has an environment that next does not have, it should be added to next
-			toBeAdded = append(toBeAdded, prevEnv)
+			// The installation is not in next, its remotes are removed
+			if len(prevEnv.Remotes) > 0 {
+				toBeRemoved = append(toBeRemoved, model.Environment{
+					Core:             map[string]string{},
+					Remotes:          prevEnv.Remotes,
+					InstallationType: prevEnv.InstallationType,
+				})
+			}
 			continue
 		}
 
@@ -123,7 +144,7 @@ func compareEnvironments(prev, next []model.Environment) (toBeAdded, toBeRemoved
 		}
 
 		if len(coreDiff.removed) > 0 || len(remotesDiff.removed) > 0 {
-			toBeRemoved = append(toBeUpdated, removedEnv)
+			toBeRemoved = append(toBeRemoved, removedEnv)
 		}
 
 		if len(coreDiff.updated) > 0 || len(remotesDiff.updated) > 0 {
@@ -131,10 +152,11 @@ func compareEnvironments(prev, next []model.Environment) (toBeAdded, toBeRemoved
 		}
 	}
 
-	// Check for environments in next that are not in prev (should not happen)
-	for key, nextEnv := range nextMap {
-		if _, exists := prevMap[key]; !exists {
-			toBeRemoved = append(toBeRemoved, nextEnv)
+	// Installations that are not in prev, such as a user installation that does not
+	// exist yet, get all their remotes. The first remote-add creates the repo.
+	for _, nextEnv := range next {
+		if _, exists := prevMap[nextEnv.InstallationType]; !exists && len(nextEnv.Remotes) > 0 {
+			toBeAdded = append(toBeAdded, nextEnv)
 		}
 	}
 
@@ -166,6 +188,14 @@ func compareCore(prevCore, nextCore map[string]string) diffCore {
 	return d
 }
 
+// remoteValueEqual compares a remote option, GPG keys are compared by fingerprint
+func remoteValueEqual(key, prevValue, nextValue string) bool {
+	if key == model.RemoteGPGKey {
+		return utility.SameGPGKey(prevValue, nextValue)
+	}
+	return prevValue == nextValue
+}
+
 func compareRemotes(prevRemotes, nextRemotes map[string]map[string]string) diffRemote {
 	d := diffRemote{
 		added:   make(map[string]map[string]string),
@@ -177,30 +207,28 @@ func compareRemotes(prevRemotes, nextRemotes map[string]map[string]string) diffR
 		if nextRemote, exists := nextRemotes[k]; !exists {
 			d.removed[k] = prevRemote
 		} else {
-			addedRemote := make(map[string]string)
 			updatedRemote := make(map[string]string)
-			removedRemote := make(map[string]string)
 			for rk, rv := range prevRemote {
-				if nextVal, exists := nextRemote[rk]; !exists {
-					removedRemote[rk] = rv
-				} else if rv != nextVal {
+				// The options of a .flatpakrepo URL are unknown until the remote is added
+				if rk == model.RemoteFromURL {
+					continue
+				}
+				if nextVal, exists := nextRemote[rk]; exists && !remoteValueEqual(rk, rv, nextVal) {
 					updatedRemote[rk] = nextVal
 				}
 			}
+			// Options added to an existing remote, e.g. the title and icon of a .flatpakrepo file,
+			// are set with remote-modify: adding the remote again for them would drop its installed refs.
+			// Options missing from the next state are kept, the configured remotes of the system
+			// have options that compose files do not list and remote-modify cannot unset them.
 			for rk, rv := range nextRemote {
-				if _, exists := prevRemote[rk]; !exists {
-					addedRemote[rk] = rv
+				if _, exists := prevRemote[rk]; !exists && rk != model.RemoteFromURL {
+					updatedRemote[rk] = rv
 				}
 			}
 			if len(updatedRemote) > 0 {
 				d.updated[k] = updatedRemote
 			}
-			if len(addedRemote) > 0 {
-				d.added[k] = addedRemote
-			}
-			if len(updatedRemote) > 0 {
-				d.removed[k] = removedRemote
-			}
 		}
 	}
 
@@ -213,6 +241,47 @@ func compareRemotes(prevRemotes, nextRemotes map[string]map[string]string) diffR
 	return d
 }
 
+// sameApplication reports whether an installed application is the application of the desired state
+func sameApplication(currentApp, nextApp model.FlatpakApplication) bool {
+	return currentApp.Name == nextApp.Name && currentApp.InstallationType == nextApp.InstallationType && nextApp.SameOrigin(currentApp.Repo)
+}
+
+// hasApplication reports whether an installed application is part of the desired state
+func hasApplication(currentApp model.FlatpakApplication, nextApps []model.FlatpakApplication) bool {
+	for _, nextApp := range nextApps {
+		if sameApplication(currentApp, nextApp) {
+			return true
+		}
+	}
+	return false
+}
+
+// keepOriginRemotes drops from the removed environments the origin remotes
+// created by flatpak for applications installed from local files.
+func keepOriginRemotes(envs []model.Environment, nextApps []model.FlatpakApplication) []model.Environment {
+	var result []model.Environment
+	for _, env := range envs {
+		remotes := make(map[string]map[string]string)
+		for name, remote := range env.Remotes {
+			origin := false
+			for _, app := range nextApps {
+				if app.IsLocalSource() && app.InstallationType == env.InstallationType && app.SameOrigin(name) {
+					origin = true
+					break
+				}
+			}
+			if !origin {
+				remotes[name] = remote
+			}
+		}
+		if len(remotes) > 0 || len(env.Core) > 0 {
+			env.Remotes = remotes
+			result = append(result, env)
+		}
+	}
+	return result
+}
+
 // Function to compare Flatpak Applications
 func compareApplications(nextRepos []model.Environment, currentApps []model.FlatpakApplication, nextApps []model.FlatpakApplication) ([]model.FlatpakApplication, []model.FlatpakApplication) {
 	var appsToAdd []model.FlatpakApplication
@@ -222,30 +291,18 @@ func compareApplications(nextRepos []model.Environment, currentApps []model.Flat
 	// We assume that currentApps is valid.
 	// nextApps is the desidered state.
 
-	nextAppMap := make(map[string]bool)
-	// Calculate key indexing for the desired state
-	for _, app := range nextApps {
-		key := fmt.Sprintf("%s|%s|%s", app.Repo, app.InstallationType, app.Name)
-		nextAppMap[key] = true
-	}
 	// Check if currentApps is not present in the desidered state.
 	for _, app := range currentApps {
-		key := fmt.Sprintf("%s|%s|%s", app.Repo, app.InstallationType, app.Name)
-		if _, exists := nextAppMap[key]; !exists {
+		if !hasApplication(app, nextApps) {
 			// if it NOT present, remove it.
 			appsToRemove = append(appsToRemove, app)
 		}
 	}
-	// Calculate index of current app.
-	currentAppMap := make(map[string]bool)
-	for _, app := range currentApps {
-		key := fmt.Sprintf("%s|%s|%s", app.Repo, app.InstallationType, app.Name)
-		currentAppMap[key] = true
-	}
 
 	// For each application in the desidered state.
 	for _, app := range nextApps {
-		found:= false;
+		// Applications installed from local files have no remote to validate
+		found:= app.IsLocalSource();
 		// repo Validation?
 		for _, nextEnv := range nextRepos {
 			if nextEnv.RemoteExists(app.InstallationType,app.Repo){
@@ -255,13 +312,18 @@ func compareApplications(nextRepos []model.Environment, currentApps []model.Flat
 		}
 
 		if (!found) {
-			fmt.Println("Invalid Remote validation: ",app.Name,  app.Repo, app.InstallationType)
+			fmt.Fprintln(os.Stderr, "Invalid Remote validation: ",app.Name,  app.Repo, app.InstallationType)
 			break;
 		}
-		// Calculate index key
-		key := fmt.Sprintf("%s|%s|%s", app.Repo, app.InstallationType, app.Name)
 		// check if the apps exists in the current state.
-		if _, exists := currentAppMap[key]; !exists {
+		installed := false
+		for _, currentApp := range currentApps {
+			if sameApplication(currentApp, app) {
+				installed = true
+				break
+			}
+		}
+		if !installed {
 			// If it not, add it.
 			appsToAdd = append(appsToAdd, app)
 		}
@@ -270,84 +332,102 @@ func compareApplications(nextRepos []model.Environment, currentApps []model.Flat
 	return appsToAdd, appsToRemove
 }
 
-// Function to compare Flatpak Application Permissions (Overrides)
-func comparePermissions(currentApps []model.FlatpakApplication, nextApps []model.FlatpakApplication) ([]model.FlatpakApplication,[]model.FlatpakApplication)  {
-	var appsPermissionRemove,appsPermissionAdd []model.FlatpakApplication
+// overridesDelta returns the overrides to add and to remove to go from current to next
+func overridesDelta(current, next []string) (added, removed []string) {
+	for _, value := range next {
+		if !StringExistsInArray(value, current) && !StringExistsInArray(value, added) {
+			added = append(added, value)
+		}
+	}
+	for _, value := range current {
+		if !StringExistsInArray(value, next) && !StringExistsInArray(value, removed) {
+			removed = append(removed, value)
+		}
+	}
+	return
+}
+
+// Function to compare the overrides of the applications in exact mode
+func compareExactOverrides(currentApps []model.FlatpakApplication, nextApps []model.FlatpakApplication) []OverrideReset {
+	var resets []OverrideReset
+	for _, nextApp := range nextApps {
+		if nextApp.OverrideMode != model.OverrideModeExact {
+			continue
+		}
+		for _, currentApp := range currentApps {
+			if !sameApplication(currentApp, nextApp) {
+				continue
+			}
+			app := model.FlatpakApplication{
+				Name:             nextApp.Name,
+				Repo:             nextApp.Repo,
+				InstallationType: nextApp.InstallationType,
+			}
+			// Only the scopes with an effective change are reset
+			if added, removed := overridesDelta(currentApp.Overrides, nextApp.Overrides); added != nil || removed != nil {
+				resets = append(resets, OverrideReset{App: app, Scope: "system", Flags: nextApp.Overrides, Added: added, Removed: removed})
+			}
+			if added, removed := overridesDelta(currentApp.OverridesUser, nextApp.OverridesUser); added != nil || removed != nil {
+				resets = append(resets, OverrideReset{App: app, Scope: "user", Flags: nextApp.OverridesUser, Added: added, Removed: removed})
+			}
+			break
+		}
+	}
+	return resets
+}
+
+// Function to compare Flatpak Application Permissions (Overrides).
+// The overrides are merged: the ones missing in the next state are kept, exact mode removes them.
+func comparePermissions(currentApps []model.FlatpakApplication, nextApps []model.FlatpakApplication) []model.FlatpakApplication {
+	var appsPermissionAdd []model.FlatpakApplication
 	// Iterate the desidered state (nextApps)
 	for _, nextApp := range nextApps {
+		// Applications in exact mode are handled by compareExactOverrides
+		if nextApp.OverrideMode == model.OverrideModeExact {
+			continue
+		}
 		// Iterate the current state to find the related couple (nextApp,currentApp)
 		for _, currentApp := range currentApps {
-			if nextApp.Name == currentApp.Name && nextApp.Repo == currentApp.Repo && nextApp.InstallationType == currentApp.InstallationType {
-				// Found it.
-
-				// Compare overrides
+			if sameApplication(currentApp, nextApp) {
 				appAdd := model.FlatpakApplication{
 					Name:             nextApp.Name,
 					Repo:             nextApp.Repo,
 					InstallationType: nextApp.InstallationType,
 				}
-
-				appRemove := model.FlatpakApplication{
-					Name:             nextApp.Name,
-					Repo:             nextApp.Repo,
-					InstallationType: nextApp.InstallationType,
-				}
-
-				//overridesChanged := false
-				// Iterate the desidered state.
-				for _, value := range nextApp.Overrides {
-					// For each key in the desired state, is it available on the previous state?
-					if !StringExistsInArray(value, currentApp.Overrides) {
-						// NO. need to add it.
-						//overridesChanged = true
-						appRemove.Overrides = append(appRemove.Overrides, value)
-					}
-				}
-				// Iterate the curent state and see if fields are missing in the desidered state.
-				// If yes, please delete it.
-				for _, value := range currentApp.Overrides {
-					// For each key in the desired state, is it available on the previous state?
-					if !StringExistsInArray(value, nextApp.Overrides) {
-						// NO. need to add it.
-						//overridesChanged = true
-						appAdd.Overrides = append(appAdd.Overrides, value)
-					}
-				}
-
-
-				for _, value := range nextApp.OverridesUser {
-					// For each key in the desired state, is it available on the previous state?
-					if !StringExistsInArray(value, currentApp.OverridesUser) {
-						// NO. need to add it.
-						//overridesChanged = true
-						appRemove.OverridesUser = append(appRemove.OverridesUser, value)
-					}
-				}
-
-				//overridesUserChanged := false
-				for _, value := range nextApp.OverridesUser {
-					// For each key in the desired state, is it available on the previous state?
-					if !StringExistsInArray(value, currentApp.OverridesUser) {
-						//overridesUserChanged = true
-						appAdd.OverridesUser = append(appAdd.OverridesUser, value)
-					}
-				}
-
-				if (appAdd.OverridesUser != nil) {
+				appAdd.Overrides, _ = overridesDelta(currentApp.Overrides, nextApp.Overrides)
+				appAdd.OverridesUser, _ = overridesDelta(currentApp.OverridesUser, nextApp.OverridesUser)
+				if appAdd.Overrides != nil || appAdd.OverridesUser != nil {
 					appsPermissionAdd = append(appsPermissionAdd, appAdd)
 				}
 
-				if (appRemove.Overrides != nil) {
-					appsPermissionRemove = append(appsPermissionRemove, appRemove)
-				}
-
 				// Let's go out... we found the related app.
 				break;
 			}
 		}
 	}
 
-	return appsPermissionAdd,appsPermissionRemove
+	return appsPermissionAdd
+}
+
+// Function to compare the update masks with the update policies
+func compareMasks(currentApps []model.FlatpakApplication, nextApps []model.FlatpakApplication) ([]model.FlatpakApplication, []model.FlatpakApplication) {
+	var masksToAdd, masksToRemove []model.FlatpakApplication
+	for _, nextApp := range nextApps {
+		masked := false
+		for _, currentApp := range currentApps {
+			if sameApplication(currentApp, nextApp) {
+				masked = currentApp.Masked
+				break
+			}
+		}
+		// Only an explicit always or manual policy removes an existing mask
+		if nextApp.IsMaskedPolicy() && !masked {
+			masksToAdd = append(masksToAdd, nextApp)
+		} else if masked && (nextApp.UpdatePolicy == model.UpdatePolicyAlways || nextApp.UpdatePolicy == model.UpdatePolicyManual) {
+			masksToRemove = append(masksToRemove, nextApp)
+		}
+	}
+	return masksToAdd, masksToRemove
 }
 
 // Function to compare Flatpak Application Dynamic Permissions
@@ -357,7 +437,7 @@ func compareDynamicPermissions(currentApps []model.FlatpakApplication, nextApps
 	for _, nextApp := range nextApps {
 		// Iterate the current state to find the related couple (nextApp,currentApp)
 		for _, currentApp := range currentApps {
-			if nextApp.Name == currentApp.Name && nextApp.Repo == currentApp.Repo && nextApp.InstallationType == currentApp.InstallationType {
+			if sameApplication(currentApp, nextApp) {
 				// Found it.
 
 				// Compare overrides
@@ -416,10 +496,14 @@ func GetDiffState(currentState, nextState model.State) DiffState {
 	// Handle differences as needed...
 	// Compare repositories
 	envToAdd, envToRemove, envToUpdate := compareEnvironments(currentState.Environment, nextState.Environment)
+	envToRemove = keepOriginRemotes(envToRemove, nextState.Applications)
 	// Compare applications
 	appsToAdd, appsToRemove := compareApplications(nextState.Environment, currentState.Applications, nextState.Applications)
 	// Compare permissions
-	permToAdd, permToRemove := comparePermissions(currentState.Applications, nextState.Applications)
+	permToAdd := comparePermissions(currentState.Applications, nextState.Applications)
+	overridesToReset := compareExactOverrides(currentState.Applications, nextState.Applications)
+	// Compare update masks
+	masksToAdd, masksToRemove := compareMasks(currentState.Applications, nextState.Applications)
 	// Compare dynamic permissions
 	dynamicPermToAdd, dynamicPermToRemove := compareDynamicPermissions(currentState.Applications, nextState.Applications)
 
@@ -430,9 +514,11 @@ func GetDiffState(currentState, nextState model.State) DiffState {
 		AppsToAdd:              appsToAdd,
 		AppsToRemove:           appsToRemove,
 		PermToAdd: 		permToAdd,
-		PermToRemove: 		permToRemove,
 		DynamicPermToAdd: 	dynamicPermToAdd,
 		DynamicPermToRemove: 	dynamicPermToRemove,
+		OverridesToReset: 	overridesToReset,
+		MasksToAdd: 		masksToAdd,
+		MasksToRemove: 		masksToRemove,
 	}
 
 }
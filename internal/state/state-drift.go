@@ -0,0 +1,141 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// Drift causes
+const (
+	DriftManual  = "manual"  // The system was changed outside of flatpak-compose (e.g. Flatseal or the flatpak CLI)
+	DriftCompose = "compose" // The compose file changed since the last apply
+	DriftBoth    = "both"    // Both the system and the compose file changed
+)
+
+// DriftItem is an item that differs between the last-applied, desired and actual states.
+// Empty values mean that the item is absent from the state.
+type DriftItem struct {
+	Kind        string // application, remote, override or permission
+	Name        string
+	LastApplied string
+	Desired     string
+	Actual      string
+	Cause       string
+}
+
+// driftValue is the value of an item in one of the compared states
+type driftValue struct {
+	kind  string
+	owner string // Application or remote the item belongs to
+	name  string
+	value string
+}
+
+// stateItems flattens a state into comparable items indexed by key
+func stateItems(s model.State) map[string]driftValue {
+	items := make(map[string]driftValue)
+
+	for _, env := range s.Environment {
+		for remoteName, remote := range env.Remotes {
+			owner := "remote|" + env.InstallationType + "|" + remoteName
+			label := env.InstallationType + "/" + remoteName
+			items[owner] = driftValue{kind: "remote", owner: owner, name: label, value: "present"}
+			for option, value := range remote {
+				items[owner+"|"+option] = driftValue{kind: "remote", owner: owner, name: label + " " + option, value: value}
+			}
+		}
+	}
+
+	for _, app := range s.Applications {
+		owner := "app|" + app.InstallationType + "|" + app.Name
+		label := app.InstallationType + "/" + app.Name
+		items[owner] = driftValue{kind: "application", owner: owner, name: label, value: app.Repo + " " + app.Branch}
+		for _, flag := range app.Overrides {
+			items[owner+"|system|"+flag] = driftValue{kind: "override", owner: owner, name: label + " system " + flag, value: "set"}
+		}
+		for _, flag := range app.OverridesUser {
+			items[owner+"|user|"+flag] = driftValue{kind: "override", owner: owner, name: label + " user " + flag, value: "set"}
+		}
+		for _, p := range app.Permissions {
+			items[owner+"|permission|"+p.Table+"|"+p.Object] = driftValue{
+				kind:  "permission",
+				owner: owner,
+				name:  fmt.Sprintf("%s %s/%s", label, p.Table, p.Object),
+				value: strings.TrimSpace(p.Permission + " " + p.Data),
+			}
+		}
+	}
+	return items
+}
+
+// sameDriftValue compares the values of an item, GPG keys are compared by fingerprint
+func sameDriftValue(key, a, b string) bool {
+	if strings.HasSuffix(key, "|"+model.RemoteGPGKey) && a != "" && b != "" {
+		return utility.SameGPGKey(a, b)
+	}
+	return a == b
+}
+
+// GetDriftState compares the last-applied, desired and actual states.
+// Only the applications and remotes managed by the compose file, now or at the last apply, are compared.
+func GetDriftState(lastApplied, desired, actual model.State) []DriftItem {
+	lastItems := stateItems(lastApplied)
+	desiredItems := stateItems(desired)
+	actualItems := stateItems(actual)
+
+	managed := make(map[string]bool)
+	keys := make(map[string]bool)
+	for key, item := range lastItems {
+		managed[item.owner] = true
+		keys[key] = true
+	}
+	for key, item := range desiredItems {
+		managed[item.owner] = true
+		keys[key] = true
+	}
+	// Overrides and permissions added by hand on managed applications are drift too,
+	// remote options that were never declared are not.
+	for key, item := range actualItems {
+		if managed[item.owner] && (item.kind == "override" || item.kind == "permission") {
+			keys[key] = true
+		}
+	}
+
+	var drift []DriftItem
+	for key := range keys {
+		var item DriftItem
+		for _, v := range []driftValue{lastItems[key], desiredItems[key], actualItems[key]} {
+			if v.kind != "" {
+				item.Kind, item.Name = v.kind, v.name
+			}
+		}
+		item.LastApplied = lastItems[key].value
+		item.Desired = desiredItems[key].value
+		item.Actual = actualItems[key].value
+
+		manual := !sameDriftValue(key, item.LastApplied, item.Actual)
+		compose := !sameDriftValue(key, item.LastApplied, item.Desired)
+		switch {
+		case manual && compose:
+			item.Cause = DriftBoth
+		case manual:
+			item.Cause = DriftManual
+		case compose:
+			item.Cause = DriftCompose
+		default:
+			continue
+		}
+		drift = append(drift, item)
+	}
+
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].Cause != drift[j].Cause {
+			return drift[i].Cause > drift[j].Cause
+		}
+		return drift[i].Name < drift[j].Name
+	})
+	return drift
+}
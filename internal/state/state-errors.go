@@ -0,0 +1,53 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Parts of the system state, used by SystemStateError
+const (
+	PartInstallations = "installations"
+	PartApplications  = "applications"
+	PartEnvironment   = "environment"
+	PartMetadata      = "metadata"
+	PartOverrides     = "overrides"
+	PartPermissions   = "permissions"
+)
+
+// SystemStateError is a failure to read a part of the system state
+type SystemStateError struct {
+	Part   string // One of the Part constants
+	Target string // Installation or application, empty for the whole system
+	Err    error
+}
+
+func (e *SystemStateError) Error() string {
+	if e.Target == "" {
+		return fmt.Sprintf("cannot read %s: %v", e.Part, e.Err)
+	}
+	return fmt.Sprintf("cannot read %s of %s: %v", e.Part, e.Target, e.Err)
+}
+
+func (e *SystemStateError) Unwrap() error {
+	return e.Err
+}
+
+// PartialStateError reports the parts of the system state that could not be read.
+// The state returned with it holds everything else.
+type PartialStateError struct {
+	Errors []error
+}
+
+func (e *PartialStateError) Error() string {
+	var messages []string
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return "incomplete system state: " + strings.Join(messages, "; ")
+}
+
+func (e *PartialStateError) Unwrap() []error {
+	return e.Errors
+}
+
@@ -1,12 +1,157 @@
 package state 
 
 import (
+	"encoding/base64"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
 )
 
+// resolvePath resolves a path found in the compose file relative to the compose file directory
+func resolvePath(baseDir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(baseDir, path)
+}
+
+// resolveRemoteFiles loads the local files referenced by the remotes of an environment
+func resolveRemoteFiles(env model.Environment, baseDir string) error {
+	for name, remote := range env.Remotes {
+		if repoFile, ok := remote[model.RemoteFrom]; ok {
+			delete(remote, model.RemoteFrom)
+			repoOptions, err := utility.ReadFlatpakRepoFile(resolvePath(baseDir, repoFile))
+			if err != nil {
+				return fmt.Errorf("remote '%s': cannot read %s: %w", name, repoFile, err)
+			}
+			// Options written in the compose file take precedence over the .flatpakrepo file
+			for k, v := range repoOptions {
+				if _, exists := remote[k]; !exists {
+					remote[k] = v
+				}
+			}
+		}
+
+		keyFile, ok := remote[model.RemoteGPGKeyFile]
+		if !ok {
+			continue
+		}
+		delete(remote, model.RemoteGPGKeyFile)
+		if keyFile == "" {
+			continue
+		}
+		keyData, err := utility.ReadGPGKeyFile(resolvePath(baseDir, keyFile))
+		if err != nil {
+			return fmt.Errorf("remote '%s': cannot read gpg key file: %w", name, err)
+		}
+		remote[model.RemoteGPGKey] = base64.StdEncoding.EncodeToString(keyData)
+	}
+	return nil
+}
+
+// resolveRemoteProtection moves the protect option of the remotes to the protected list of the environment,
+// it is not a remote option for flatpak
+func resolveRemoteProtection(env *model.Environment) error {
+	for name, remote := range env.Remotes {
+		value, ok := remote[model.RemoteProtect]
+		if !ok {
+			continue
+		}
+		delete(remote, model.RemoteProtect)
+		protect, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("remote '%s': invalid protect value: %s", name, value)
+		}
+		if protect && !env.IsProtected(name) {
+			env.Protected = append(env.Protected, name)
+		}
+	}
+	sort.Strings(env.Protected)
+	return nil
+}
+
+// resolveLocalSource resolves the file of an application installed from a bundle or a .flatpakref,
+// the branch written in the file and the name of the origin remote flatpak creates for it
+func resolveLocalSource(app *model.FlatpakApplication, baseDir string) error {
+	if app.Path == "" {
+		return fmt.Errorf("application '%s' with source '%s' requires a path", app.Name, app.Source)
+	}
+	app.Path = resolvePath(baseDir, app.Path)
+	if _, err := os.Stat(app.Path); err != nil {
+		return fmt.Errorf("application '%s': %w", app.Name, err)
+	}
+
+	if app.Source == model.SourceFlatpakRef {
+		ref, err := utility.ReadFlatpakRefFile(app.Path)
+		if err != nil {
+			return fmt.Errorf("application '%s': cannot read %s: %w", app.Name, app.Path, err)
+		}
+		if app.Name == "" {
+			app.Name = ref["Name"]
+		}
+		if app.Branch == "" {
+			app.Branch = ref["Branch"]
+		}
+		// flatpak installs the master branch when the file has none
+		if app.Branch == "" {
+			app.Branch = "master"
+		}
+		// flatpak adds the suggested remote if the file provides one
+		if app.Repo == "" {
+			app.Repo = ref["SuggestRemoteName"]
+		}
+	}
+	if app.Source == model.SourceBundle {
+		ref, err := utility.ReadBundleRef(app.Path)
+		if err != nil {
+			return fmt.Errorf("application '%s': cannot read %s: %w", app.Name, app.Path, err)
+		}
+		// app/<id>/<arch>/<branch>
+		parts := strings.Split(ref, "/")
+		if app.Name == "" {
+			app.Name = parts[1]
+		}
+		if app.Branch == "" {
+			app.Branch = parts[3]
+		}
+	}
+	if app.Repo == "" {
+		app.Repo = app.Name + "-origin"
+	}
+	return nil
+}
+
+// ValidateInstallations checks that the installation types of a state are installations of the system:
+// user, system or a custom installation. File states are compared offline with installations of other
+// machines, so the check is made only when the state is compared with the system.
+func ValidateInstallations(s model.State) error {
+	installations, err := utility.GetInstallations()
+	if err != nil {
+		return err
+	}
+	installationTypes := make(map[string]bool)
+	for _, installation := range installations {
+		installationTypes[installation.ID] = true
+	}
+	for _, env := range s.Environment {
+		if !installationTypes[env.InstallationType] {
+			return fmt.Errorf("environment has an unknown installation type: %s", env.InstallationType)
+		}
+	}
+	for _, app := range s.Applications {
+		if !installationTypes[app.InstallationType] {
+			return fmt.Errorf("application '%s' has an invalid InstallationType: %s", app.Name, app.InstallationType)
+		}
+	}
+	return nil
+}
+
 func GetFileState(stateFile string) (model.State, error) {
 	var config model.State
 
@@ -24,6 +169,12 @@ func GetFileState(stateFile string) (model.State, error) {
 		if config.Environment[i].InstallationType == "" {
 			config.Environment[i].InstallationType = "system" // or any default value you prefer
 		}
+		if err := resolveRemoteFiles(config.Environment[i], filepath.Dir(stateFile)); err != nil {
+			return config, err
+		}
+		if err := resolveRemoteProtection(&config.Environment[i]); err != nil {
+			return config, err
+		}
 	}
 
 	repoNames := make(map[string]bool)
@@ -38,7 +189,41 @@ func GetFileState(stateFile string) (model.State, error) {
 		}
 	}
 
+	if config.OverrideMode != "" && config.OverrideMode != model.OverrideModeMerge && config.OverrideMode != model.OverrideModeExact {
+		return config, fmt.Errorf("invalid override_mode: %s", config.OverrideMode)
+	}
+
+	if !model.IsValidUpdatePolicy(config.UpdatePolicy) {
+		return config, fmt.Errorf("invalid update_policy: %s", config.UpdatePolicy)
+	}
+
 	for i, app := range config.Applications {
+		// Inherit the global update policy
+		if app.UpdatePolicy == "" {
+			config.Applications[i].UpdatePolicy = config.UpdatePolicy
+		} else if !model.IsValidUpdatePolicy(app.UpdatePolicy) {
+			return config, fmt.Errorf("application '%s' has an invalid update_policy: %s", app.Name, app.UpdatePolicy)
+		}
+		// The mask follows the policy, as it does on a system where the state was applied
+		config.Applications[i].Masked = config.Applications[i].IsMaskedPolicy()
+
+		// Inherit the global override mode
+		if app.OverrideMode == "" {
+			config.Applications[i].OverrideMode = config.OverrideMode
+		} else if app.OverrideMode != model.OverrideModeMerge && app.OverrideMode != model.OverrideModeExact {
+			return config, fmt.Errorf("application '%s' has an invalid override_mode: %s", app.Name, app.OverrideMode)
+		}
+
+		if app.Source != "" && app.Source != model.SourceRemote && !app.IsLocalSource() {
+			return config, fmt.Errorf("application '%s' has an invalid source: %s", app.Name, app.Source)
+		}
+		if app.IsLocalSource() {
+			if err := resolveLocalSource(&config.Applications[i], filepath.Dir(stateFile)); err != nil {
+				return config, err
+			}
+			app = config.Applications[i]
+		}
+
 		// Set the default repo if not specified and only one repo exists
 		if len(config.Environment) >= 1 && len(config.Environment[0].Remotes) >= 1 && app.Repo == "" {
 			rem := config.Environment[0].Remotes
@@ -59,26 +244,36 @@ func GetFileState(stateFile string) (model.State, error) {
 
 		// Check if the repo specified for an application exists in the list of repos
 		repoExists := false
-		appRepo := app.Repo + "|" + app.InstallationType
+		appRepo := config.Applications[i].Repo + "|" + app.InstallationType
 		for k, v := range repoNames {
 			if v == true && k == appRepo {
 				repoExists = true
 				break
 			}
 		}
-		if !repoExists {
-			fmt.Printf("Warning: application '%s' refers to a non-existent repository: '%s' in '%s' mode and will be ignored during installation process but overrides will still be applied if possible\n", app.Name, app.Repo, app.InstallationType)
+		if !repoExists && !app.IsLocalSource() {
+			fmt.Fprintf(os.Stderr, "Warning: application '%s' refers to a non-existent repository: '%s' in '%s' mode and will be ignored during installation process but overrides will still be applied if possible\n", app.Name, config.Applications[i].Repo, app.InstallationType)
 		}
 
-		// Check for valid InstallationType
-		if app.InstallationType != "user" && app.InstallationType != "system" {
-			return config, fmt.Errorf("application '%s' has an invalid InstallationType: %s", app.Name, app.InstallationType)
+		// Installation types are checked against the system by ValidateInstallations
+		if app.InstallationType == "" {
+			return config, fmt.Errorf("application '%s' has no installation type", app.Name)
 		}
 
 		// Ensure application name is required
 		if app.Name == "" {
 			return config, fmt.Errorf("application name is required")
 		}
+
+		// Canonicalize the overrides so that equivalent flags are not reported as changes
+		config.Applications[i].Overrides = utility.NormalizeFlags(app.Overrides)
+		config.Applications[i].OverridesUser = utility.NormalizeFlags(app.OverridesUser)
+		if err := utility.FlagConflicts(app.Overrides); err != nil {
+			return config, fmt.Errorf("application '%s' overrides: %w", app.Name, err)
+		}
+		if err := utility.FlagConflicts(app.OverridesUser); err != nil {
+			return config, fmt.Errorf("application '%s' overrides_user: %w", app.Name, err)
+		}
 	}
 	return config, nil
 }
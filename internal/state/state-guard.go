@@ -0,0 +1,76 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"github.com/faan11/flatpak-compose/internal/model"
+)
+
+// isProtectedApplication reports whether an application is protected in one of the states
+func isProtectedApplication(app model.FlatpakApplication, states ...model.State) bool {
+	for _, s := range states {
+		for _, protectedApp := range s.Applications {
+			if protectedApp.Protect && protectedApp.Name == app.Name && protectedApp.InstallationType == app.InstallationType {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isProtectedRemote reports whether a remote is protected in one of the states
+func isProtectedRemote(installationType, name string, states ...model.State) bool {
+	for _, s := range states {
+		for _, env := range s.Environment {
+			if env.InstallationType == installationType && env.IsProtected(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckDestructiveChanges returns an error for each removal of the diff that requires --allow-destroy:
+// protected applications and remotes, remotes that still have installed applications, and more
+// application removals than the guard of the compose file allows.
+// Protection is also read from the last applied state, so that items deleted from the compose
+// file stay protected.
+func CheckDestructiveChanges(diff DiffState, currentState, nextState, lastApplied model.State) error {
+	var errs []error
+
+	for _, app := range diff.AppsToRemove {
+		if isProtectedApplication(app, nextState, lastApplied) {
+			errs = append(errs, fmt.Errorf("application '%s' (%s) is protected", app.Name, app.InstallationType))
+		}
+	}
+
+	for _, env := range diff.EnvToRemove {
+		for name := range env.Remotes {
+			if isProtectedRemote(env.InstallationType, name, nextState, lastApplied) {
+				errs = append(errs, fmt.Errorf("remote '%s' (%s) is protected", name, env.InstallationType))
+			}
+			// flatpak refuses to delete a remote in use, unless forced
+			for _, app := range currentState.Applications {
+				if app.Repo != name || app.InstallationType != env.InstallationType {
+					continue
+				}
+				removed := false
+				for _, removedApp := range diff.AppsToRemove {
+					if removedApp.Name == app.Name && removedApp.InstallationType == app.InstallationType {
+						removed = true
+						break
+					}
+				}
+				if !removed {
+					errs = append(errs, fmt.Errorf("remote '%s' (%s) still has the installed application '%s'", name, env.InstallationType, app.Name))
+				}
+			}
+		}
+	}
+
+	if limit := nextState.Guard.RemovalLimit(); limit >= 0 && len(diff.AppsToRemove) > limit {
+		errs = append(errs, fmt.Errorf("the plan removes %d applications, more than the limit of %d (guard.max_removals)", len(diff.AppsToRemove), limit))
+	}
+
+	return errors.Join(errs...)
+}
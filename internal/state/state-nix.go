@@ -0,0 +1,214 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// nixDefaultOrigin is the remote of the nix-flatpak packages without origin
+const nixDefaultOrigin = "flathub"
+
+// nixFlatpakConfig is the JSON rendering of the services.flatpak options of the nix-flatpak module,
+// e.g. the output of nix eval --json .#homeConfigurations.<user>.config.services.flatpak
+type nixFlatpakConfig struct {
+	Remotes   []nixRemote                                    `json:"remotes"`
+	Packages  []nixPackage                                   `json:"packages"`
+	Overrides map[string]map[string]map[string]interface{} `json:"overrides"` // Application, group, key
+}
+
+type nixRemote struct {
+	Name     string `json:"name"`
+	Location string `json:"location"` // URL of the repo or of a .flatpakrepo file
+}
+
+type nixPackage struct {
+	AppID      string `json:"appId"` // id or id//branch
+	Origin     string `json:"origin"`
+	Bundle     string `json:"bundle"`
+	FlatpakRef string `json:"flatpakref"`
+}
+
+// UnmarshalJSON accepts the packages written as a plain application id
+func (p *nixPackage) UnmarshalJSON(data []byte) error {
+	var appID string
+	if err := json.Unmarshal(data, &appID); err == nil {
+		*p = nixPackage{AppID: appID}
+		return nil
+	}
+	type plain nixPackage
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// GetNixState reads the JSON rendering of a nix-flatpak configuration. nix-flatpak manages a single
+// installation, the user one with home-manager and the system one with NixOS, given by installationType.
+// Its overrides are the overrides of that scope.
+func GetNixState(stateFile string, installationType string) (model.State, error) {
+	var state model.State
+
+	data, err := os.ReadFile(stateFile)
+	if err != nil {
+		return state, err
+	}
+	var config nixFlatpakConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return state, fmt.Errorf("%s: %w", stateFile, err)
+	}
+	baseDir := filepath.Dir(stateFile)
+
+	env := model.Environment{
+		Core:             make(map[string]string),
+		Remotes:          make(map[string]map[string]string),
+		InstallationType: installationType,
+	}
+	for _, remote := range config.Remotes {
+		if remote.Name == "" {
+			return state, fmt.Errorf("remote without name")
+		}
+		options, err := nixRemoteOptions(remote.Location, baseDir)
+		if err != nil {
+			return state, fmt.Errorf("remote '%s': %w", remote.Name, err)
+		}
+		env.Remotes[remote.Name] = options
+	}
+	state.Environment = append(state.Environment, env)
+
+	for _, pkg := range config.Packages {
+		app, err := nixApplication(pkg, installationType, baseDir)
+		if err != nil {
+			return state, err
+		}
+		state.Applications = append(state.Applications, app)
+	}
+
+	var appIDs []string
+	for appID := range config.Overrides {
+		appIDs = append(appIDs, appID)
+	}
+	sort.Strings(appIDs)
+	for _, appID := range appIDs {
+		flags, err := nixOverrideFlags(config.Overrides[appID])
+		if err != nil {
+			return state, fmt.Errorf("overrides of '%s': %w", appID, err)
+		}
+		found := false
+		for i, app := range state.Applications {
+			if app.Name != appID {
+				continue
+			}
+			found = true
+			if installationType == utility.UserInstallationType {
+				state.Applications[i].OverridesUser = flags
+			} else {
+				state.Applications[i].Overrides = flags
+			}
+		}
+		if !found {
+			// Global overrides and overrides of applications that are not packages have no place in the state
+			fmt.Fprintf(os.Stderr, "Warning: overrides of '%s' are ignored, it is not in the packages\n", appID)
+		}
+	}
+	return state, nil
+}
+
+// nixRemoteOptions returns the options of a remote from its location: a local .flatpakrepo file,
+// the URL of a .flatpakrepo file or the URL of the repo. A .flatpakrepo URL is not downloaded,
+// flatpak remote-add reads it when the remote is added.
+func nixRemoteOptions(location, baseDir string) (map[string]string, error) {
+	if !strings.HasSuffix(location, ".flatpakrepo") {
+		return map[string]string{"url": location}, nil
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return map[string]string{model.RemoteFromURL: location}, nil
+	}
+	return utility.ReadFlatpakRepoFile(resolvePath(baseDir, strings.TrimPrefix(location, "file://")))
+}
+
+// nixApplication converts a nix-flatpak package to an application
+func nixApplication(pkg nixPackage, installationType, baseDir string) (model.FlatpakApplication, error) {
+	app := model.FlatpakApplication{
+		Name:             pkg.AppID,
+		Repo:             pkg.Origin,
+		InstallationType: installationType,
+	}
+	if i := strings.Index(pkg.AppID, "//"); i != -1 {
+		app.Name, app.Branch = pkg.AppID[:i], pkg.AppID[i+2:]
+	}
+
+	switch {
+	case pkg.Bundle != "":
+		app.Source = model.SourceBundle
+		app.Path = strings.TrimPrefix(pkg.Bundle, "file://")
+	case pkg.FlatpakRef != "":
+		app.Source = model.SourceFlatpakRef
+		app.Path = strings.TrimPrefix(pkg.FlatpakRef, "file://")
+		// flatpak installs .flatpakref files from URLs, they cannot be read here
+		if strings.HasPrefix(app.Path, "http://") || strings.HasPrefix(app.Path, "https://") {
+			if app.Name == "" {
+				return app, fmt.Errorf("package from %s requires an appId", app.Path)
+			}
+			if app.Repo == "" {
+				app.Repo = app.Name + "-origin"
+			}
+			if app.Branch == "" {
+				app.Branch = "stable"
+			}
+			return app, nil
+		}
+	default:
+		if app.Name == "" {
+			return app, fmt.Errorf("package without appId")
+		}
+		if app.Repo == "" {
+			app.Repo = nixDefaultOrigin
+		}
+		if app.Branch == "" {
+			app.Branch = "stable"
+		}
+		return app, nil
+	}
+
+	if err := resolveLocalSource(&app, baseDir); err != nil {
+		return app, err
+	}
+	if app.Name == "" {
+		return app, fmt.Errorf("package from %s requires an appId", app.Path)
+	}
+	return app, nil
+}
+
+// nixOverrideFlags converts the groups of a nix-flatpak override to override flags
+func nixOverrideFlags(groups map[string]map[string]interface{}) ([]string, error) {
+	k := keyfile.New()
+	var groupNames []string
+	for group := range groups {
+		groupNames = append(groupNames, group)
+	}
+	sort.Strings(groupNames)
+	for _, group := range groupNames {
+		var keys []string
+		for key := range groups[group] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			switch value := groups[group][key].(type) {
+			case string:
+				k.Set(group, key, value)
+			case []interface{}:
+				var values []string
+				for _, v := range value {
+					values = append(values, fmt.Sprint(v))
+				}
+				k.SetStringList(group, key, values)
+			}
+		}
+	}
+	return utility.ParseFlatpakPermissions(string(k.Bytes()))
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"context"
+	"errors"
+
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// GetGlobalOverrides returns the system and user overrides that apply to all applications
+func GetGlobalOverrides(ctx context.Context) ([]string, []string, error) {
+	system, systemErr := getOverrides(ctx, utility.SystemInstallation(), utility.GlobalOverride)
+	user, userErr := getOverrides(ctx, utility.UserInstallation(), utility.GlobalOverride)
+	return system, user, errors.Join(systemErr, userErr)
+}
+
+// OrphanedOverride is an override file of an application that is installed in no installation
+type OrphanedOverride struct {
+	App   string
+	Scope string // system or user
+}
+
+// GetOrphanedOverrides returns the override files of applications that are not installed
+func GetOrphanedOverrides(installedApps []model.FlatpakApplication) ([]OrphanedOverride, error) {
+	installed := make(map[string]bool)
+	for _, app := range installedApps {
+		installed[app.Name] = true
+	}
+	var orphaned []OrphanedOverride
+	for _, installation := range []utility.Installation{utility.SystemInstallation(), utility.UserInstallation()} {
+		apps, err := utility.ListOverrides(installation)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			if !installed[app] {
+				orphaned = append(orphaned, OrphanedOverride{App: app, Scope: installation.ID})
+			}
+		}
+	}
+	return orphaned, nil
+}
+
+// GetEffectivePermissions computes the sandbox of an installed application in the order of flatpak:
+// metadata defaults, then the global and application system overrides, then the global and application
+// user overrides. System overrides do not apply to the applications of the user installation.
+func GetEffectivePermissions(app model.FlatpakApplication, globalSystem, globalUser []string) []utility.EffectivePermission {
+	layers := []utility.PermissionLayer{{Name: utility.LayerMetadata, Flags: app.All}}
+	if app.InstallationType != utility.UserInstallationType {
+		layers = append(layers,
+			utility.PermissionLayer{Name: utility.LayerGlobalSystem, Flags: globalSystem},
+			utility.PermissionLayer{Name: utility.LayerSystem, Flags: app.Overrides},
+		)
+	}
+	layers = append(layers,
+		utility.PermissionLayer{Name: utility.LayerGlobalUser, Flags: globalUser},
+		utility.PermissionLayer{Name: utility.LayerUser, Flags: app.OverridesUser},
+	)
+	return utility.EffectivePermissions(layers...)
+}
@@ -0,0 +1,210 @@
+package state
+
+import (
+	"fmt"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// Prune removes the unused runtimes of an installation after applications are removed
+type Prune struct {
+	InstallationType string
+	Runtimes         []string // Runtimes (<id>/<arch>/<branch>) expected to be removed, empty without preview
+}
+
+// installedRef is a ref listed by flatpak list
+type installedRef struct {
+	installationType string
+	ref              string // <id>/<arch>/<branch>
+	runtime          string // Runtime of applications
+}
+
+// key identifies the ref across installations, the same ref can be installed in several of them
+func (r installedRef) key() string {
+	return r.installationType + "|" + r.ref
+}
+
+// canUse reports whether a ref can use a runtime or extension. Refs use the ones of their installation,
+// per-user refs can also use the ones of the system installations and flatpak keeps those as used.
+func canUse(ref, runtime installedRef) bool {
+	return runtime.installationType == ref.installationType || ref.installationType == utility.UserInstallationType
+}
+
+// listInstalledRefs lists the installed applications or runtimes
+func listInstalledRefs(kind string) ([]installedRef, error) {
+	output, err := exec.Command("flatpak", "list", "--"+kind, "--columns=ref,installation,runtime").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing installed %ss: %w", kind, err)
+	}
+	var refs []installedRef
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		ref := installedRef{ref: partialRef(strings.TrimSpace(fields[0])), installationType: utility.ParseInstallationName(fields[1])}
+		if len(fields) >= 3 {
+			ref.runtime = strings.TrimSpace(fields[2])
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// getExtensionPoints returns the extension points declared in the metadata of an installed ref
+func getExtensionPoints(ref installedRef) ([]string, error) {
+	output, err := exec.Command("flatpak", "info", utility.InstallationFlag(ref.installationType), "-M", ref.ref).Output()
+	if err != nil {
+		return nil, &SystemStateError{Part: PartMetadata, Target: ref.ref, Err: err}
+	}
+	metadata, err := keyfile.Parse(output)
+	if err != nil {
+		return nil, &SystemStateError{Part: PartMetadata, Target: ref.ref, Err: err}
+	}
+	var extensions []string
+	for _, group := range metadata.Groups() {
+		if strings.HasPrefix(group, "Extension ") {
+			extensions = append(extensions, strings.TrimPrefix(group, "Extension "))
+		}
+	}
+	return extensions, nil
+}
+
+// partialRef strips the kind of a ref: app/<id>/<arch>/<branch> becomes <id>/<arch>/<branch>
+func partialRef(ref string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(ref, "app/"), "runtime/")
+}
+
+// refID returns the id of a ref
+func refID(ref string) string {
+	return strings.Split(partialRef(ref), "/")[0]
+}
+
+// isPinned reports whether a runtime matches the xa.pinned patterns of its installation
+func isPinned(ref installedRef, envs []model.Environment) bool {
+	for _, env := range envs {
+		if env.InstallationType != ref.installationType {
+			continue
+		}
+		for _, pattern := range strings.Split(env.Core["xa.pinned"], ";") {
+			if matched, _ := path.Match(pattern, "runtime/"+ref.ref); matched && pattern != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// previewUnusedRuntimes computes the runtimes that are no longer used once the applications are removed.
+// Runtimes are used by the remaining applications, as extensions of used refs or when pinned.
+func previewUnusedRuntimes(removedApps []model.FlatpakApplication) (map[string][]string, error) {
+	installations, err := utility.GetInstallations()
+	if err != nil {
+		return nil, &SystemStateError{Part: PartInstallations, Err: err}
+	}
+	var envs []model.Environment
+	for _, installation := range installations {
+		if env, err := utility.GetInstallationEnvironment(installation); err == nil {
+			envs = append(envs, env)
+		}
+	}
+
+	runtimes, err := listInstalledRefs("runtime")
+	if err != nil {
+		return nil, err
+	}
+	apps, err := listInstalledRefs("app")
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]bool)
+	var usedRefs []installedRef
+	for _, app := range apps {
+		removed := false
+		for _, removedApp := range removedApps {
+			if removedApp.Name == refID(app.ref) && removedApp.InstallationType == app.installationType {
+				removed = true
+				break
+			}
+		}
+		if removed {
+			continue
+		}
+		usedRefs = append(usedRefs, app)
+		for _, runtime := range runtimes {
+			if app.runtime != "" && runtime.ref == partialRef(app.runtime) && canUse(app, runtime) {
+				used[runtime.key()] = true
+			}
+		}
+	}
+
+	// Runtimes and extensions can declare extension points too, repeat until nothing changes
+	checked := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, runtime := range runtimes {
+			if used[runtime.key()] && !checked[runtime.key()] {
+				usedRefs = append(usedRefs, runtime)
+			}
+		}
+		for _, ref := range usedRefs {
+			if checked[ref.key()] {
+				continue
+			}
+			checked[ref.key()] = true
+			extensions, err := getExtensionPoints(ref)
+			if err != nil {
+				return nil, err
+			}
+			for _, extension := range extensions {
+				for _, runtime := range runtimes {
+					id := refID(runtime.ref)
+					if !used[runtime.key()] && canUse(ref, runtime) && (id == extension || strings.HasPrefix(id, extension+".")) {
+						used[runtime.key()] = true
+						changed = true
+					}
+				}
+			}
+		}
+	}
+
+	unused := make(map[string][]string)
+	for _, runtime := range runtimes {
+		if !used[runtime.key()] && !isPinned(runtime, envs) {
+			unused[runtime.installationType] = append(unused[runtime.installationType], runtime.ref)
+		}
+	}
+	return unused, nil
+}
+
+// GetPrunes returns a prune operation for each installation with removed applications.
+// With preview, the runtimes that would be removed are computed from the installed refs,
+// an error means that they cannot be listed. Without preview it does not fail.
+func GetPrunes(removedApps []model.FlatpakApplication, preview bool) ([]Prune, error) {
+	var prunes []Prune
+	var unused map[string][]string
+	if preview && len(removedApps) > 0 {
+		var err error
+		unused, err = previewUnusedRuntimes(removedApps)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, app := range removedApps {
+		if seen[app.InstallationType] {
+			continue
+		}
+		seen[app.InstallationType] = true
+		runtimes := unused[app.InstallationType]
+		sort.Strings(runtimes)
+		prunes = append(prunes, Prune{InstallationType: app.InstallationType, Runtimes: runtimes})
+	}
+	return prunes, nil
+}
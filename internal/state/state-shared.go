@@ -44,7 +44,7 @@ func GetSharedState(fileState, systemState model.State) model.State {
 		// Search for matching app in systemState
 		for _, sysApp := range systemState.Applications {
 			if fileApp.Name == sysApp.Name &&
-				fileApp.Repo == sysApp.Repo &&
+				fileApp.SameOrigin(sysApp.Repo) &&
 				fileApp.Branch == sysApp.Branch &&
 				fileApp.InstallationType == sysApp.InstallationType {
 				found = true
@@ -1,135 +1,266 @@
 package state 
 
 import (
-	"log"
-	"os/exec"
 	"bufio"
+	"context"
 	"fmt"
+	"os/exec"
 	"strings"
 	"github.com/faan11/flatpak-compose/internal/utility"
 	"github.com/faan11/flatpak-compose/internal/model"
 )
 
-func GetSystemState() model.State {
+// GetSystemState reads the installed applications, the remotes, the overrides and the dynamic permissions.
+// It fails only when the installed applications cannot be listed, from disk or with the flatpak CLI.
+// The parts that cannot be read, such as the metadata of a broken application, are reported with a *PartialStateError next to the partial state.
+func GetSystemState(ctx context.Context) (model.State, error) {
 	var currentState model.State
+	var warnings []error
 
-	// Get list of installed applications
-	installedAppsCmd := exec.Command("flatpak", "list", "--app", "--columns=application,branch,origin,installation")
-	installedAppsOutput, err := installedAppsCmd.Output()
+	// Get list of installed applications with their metadata
+	apps, appWarnings, err := getInstalledApplications(ctx)
 	if err != nil {
-		log.Fatalf("Error getting installed applications: %s\n", err)
-	}
-
-	// Parse installed applications output
-	installedApps := strings.Split(string(installedAppsOutput), "\n")
-	for _, app := range installedApps {
-		fields := strings.Fields(app)
-		if len(fields) >= 2 {
-			currentState.Applications = append(currentState.Applications, model.FlatpakApplication{
-				Name:             fields[0],
-				Branch:           fields[1],
-				Repo:             fields[2],
-				InstallationType: fields[3],
-				// Add other properties as needed
-			})
+		// The flatpak CLI only knows the running system
+		if utility.Root() != "" {
+			return currentState, err
+		}
+		warnings = append(warnings, fmt.Errorf("using the flatpak CLI: %w", err))
+		apps, appWarnings, err = getInstalledApplicationsFromCLI(ctx)
+		if err != nil {
+			return currentState, err
 		}
 	}
+	warnings = append(warnings, appWarnings...)
+	currentState.Applications = apps
 
 	//
-	// Get user environment 
+	// Get the environment of the user, system and custom installations
 	//
-	uEnv, err := utility.GetUserEnvironment()
+	installations, err := utility.GetInstallations()
 	if err != nil {
-		log.Fatalf("Error getting user env: %v\n", err)
+		// The user and system installations are still returned
+		warnings = append(warnings, &SystemStateError{Part: PartInstallations, Err: err})
 	}
-	currentState.Environment = append(currentState.Environment, uEnv)
-	//
-	// Get system environment
-	//
-	sEnv, err := utility.GetSystemEnvironment()
-	if err != nil {
-		log.Fatalf("Error getting system env: %v\n", err)
-	}
-	currentState.Environment = append(currentState.Environment, sEnv)
-
-
-	// Get permissions (overrides) for installed applications
-	for i, app := range currentState.Applications {
-		permissionsCmd := exec.Command("flatpak", "override", app.Name, "--show")
-		permissionsOutput, err := permissionsCmd.Output()
+	for _, installation := range installations {
+		env, err := utility.GetInstallationEnvironment(installation)
 		if err != nil {
-			log.Fatalf("Error getting permissions for %s: %s\n", app.Name, err)
+			warnings = append(warnings, &SystemStateError{Part: PartEnvironment, Target: installation.ID, Err: err})
+			continue
 		}
+		currentState.Environment = append(currentState.Environment, env)
+	}
 
-		currentState.Applications[i].Overrides = utility.MapPermissionsToFlatpakOverrideFlags(string(permissionsOutput))
+	// Get masked applications
+	for i, app := range currentState.Applications {
+		currentState.Applications[i].Masked = isMasked(app, currentState.Environment)
 	}
 
 	// Get permissions (overrides) for installed applications
 	for i, app := range currentState.Applications {
-		permissionsCmd := exec.Command("flatpak", "override", app.Name, "--show", "--user")
-		permissionsOutput, err := permissionsCmd.Output()
+		if err := ctx.Err(); err != nil {
+			return currentState, err
+		}
+		overrides, err := getOverrides(ctx, systemScopeInstallation(app, installations), app.Name)
+		if err != nil {
+			warnings = append(warnings, err)
+		}
+		currentState.Applications[i].Overrides = overrides
+		overrides, err = getOverrides(ctx, utility.UserInstallation(), app.Name)
 		if err != nil {
-			log.Fatalf("Error getting permissions for %s: %s\n", app.Name, err)
+			warnings = append(warnings, err)
+		}
+		currentState.Applications[i].OverridesUser = overrides
+	}
 
+	// Dynamic permissions are kept by the permission store of the running session
+	if utility.Root() == "" {
+		for i, app := range currentState.Applications {
+			if err := ctx.Err(); err != nil {
+				return currentState, err
+			}
+			permissions, err := getDynamicPermissions(ctx, app.Name)
+			if err != nil {
+				warnings = append(warnings, &SystemStateError{Part: PartPermissions, Target: app.Name, Err: err})
+			}
+			currentState.Applications[i].Permissions = permissions
 		}
+	}
 
-		currentState.Applications[i].OverridesUser = utility.MapPermissionsToFlatpakOverrideFlags(string(permissionsOutput))
+	if len(warnings) != 0 {
+		return currentState, &PartialStateError{Errors: warnings}
 	}
+	return currentState, nil
+}
 
-	// Get permissions (all) for installed applications
-	for i, app := range currentState.Applications {
-		permissionsCmd := exec.Command("flatpak", "info", app.Name, "-M")
-		permissionsOutput, err := permissionsCmd.Output()
+// getDynamicPermissions reads the permission store entries of an application with flatpak permission-show
+func getDynamicPermissions(ctx context.Context, appID string) ([]model.Permission, error) {
+	output, err := exec.CommandContext(ctx, "flatpak", "permission-show", appID).Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []model.Permission
+	scanner := bufio.NewScanner(strings.NewReader(string(output)))
+	// Skip the first line
+	scanner.Scan()
+	for scanner.Scan() {
+		permission, err := parsePermission(scanner.Text())
 		if err != nil {
-			log.Fatalf("Error getting permissions for %s: %s\n", app.Name, err)
+			return permissions, err
 		}
-
-		currentState.Applications[i].All = utility.MapPermissionsToFlatpakOverrideFlags(string(permissionsOutput))
+		permissions = append(permissions, permission)
 	}
+	return permissions, scanner.Err()
+}
 
+// getInstalledApplications reads the applications deployed in every installation from disk,
+// with the permissions of their metadata. An installation or a deploy file that cannot be read is
+// an error, the application would look uninstalled. Metadata that cannot be read is read with
+// flatpak info, it is reported as a warning when the CLI fails too or cannot be used.
+func getInstalledApplications(ctx context.Context) ([]model.FlatpakApplication, []error, error) {
+	var apps []model.FlatpakApplication
+	var warnings []error
 
-	for i, app := range currentState.Applications {
-		permissionsCmd := exec.Command("flatpak", "permission-show", app.Name)
-		stdout, err := permissionsCmd.StdoutPipe()
+	installations, err := utility.GetInstallations()
+	if err != nil {
+		// The custom installations are skipped, the error is reported with the environments
+		installations = installations[:2]
+	}
+	for _, installation := range installations {
+		deployments, err := utility.GetDeployments(installation, utility.AppKind)
 		if err != nil {
-		    log.Fatalf("Error creating stdout pipe:", err)
+			return nil, nil, &SystemStateError{Part: PartApplications, Target: installation.ID, Err: err}
 		}
-		
-		if err := permissionsCmd.Start(); err != nil {
-		    log.Fatalf("Error starting command:", err)
+		for _, deployment := range deployments {
+			// Without the deploy data the origin of the application is unknown
+			deploy, err := deployment.ReadDeployData()
+			if err != nil {
+				return nil, nil, &SystemStateError{Part: PartApplications, Target: deployment.Ref(), Err: err}
+			}
+			app := model.FlatpakApplication{
+				Name:             deployment.ID,
+				Branch:           deployment.Branch,
+				Repo:             deploy.Origin,
+				InstallationType: deployment.Installation,
+			}
+			metadata, err := deployment.ReadMetadata()
+			if err == nil {
+				app.All, err = utility.MapPermissionsToFlatpakOverrideFlags(metadata)
+			}
+			if err != nil && utility.Root() == "" {
+				app.All, err = getMetadataFromCLI(ctx, app)
+			}
+			if err != nil {
+				warnings = append(warnings, &SystemStateError{Part: PartMetadata, Target: deployment.Ref(), Err: err})
+			}
+			apps = append(apps, app)
 		}
+	}
+	return apps, warnings, nil
+}
 
-		scanner := bufio.NewScanner(stdout)
+// getInstalledApplicationsFromCLI lists the installed applications with flatpak list and reads
+// their metadata with flatpak info. Metadata that cannot be read is reported as warnings.
+func getInstalledApplicationsFromCLI(ctx context.Context) ([]model.FlatpakApplication, []error, error) {
+	var apps []model.FlatpakApplication
+	var warnings []error
 
-	    	// Skip the first line
-	    	if !scanner.Scan() {
-			if err := scanner.Err(); err != nil {
-			    log.Fatalf("Error scanning permission output:", err)
-			}
-		}
+	installedAppsCmd := exec.CommandContext(ctx, "flatpak", "list", "--app", "--columns=application,branch,origin,installation")
+	installedAppsOutput, err := installedAppsCmd.Output()
+	if err != nil {
+		return nil, nil, &SystemStateError{Part: PartApplications, Err: err}
+	}
 
-		for scanner.Scan() {
-		    line := scanner.Text()
-		    permission, err := parsePermission(line)
-		    if err != nil {
-			log.Fatalf("Error parsing permission:", err)
-			continue
-		    }
-		    currentState.Applications[i].Permissions = append(currentState.Applications[i].Permissions, permission)
+	// Parse installed applications output, columns are separated by tabs
+	installedApps := strings.Split(string(installedAppsOutput), "\n")
+	for _, app := range installedApps {
+		fields := strings.Split(app, "\t")
+		if len(fields) >= 4 {
+			apps = append(apps, model.FlatpakApplication{
+				Name:             strings.TrimSpace(fields[0]),
+				Branch:           strings.TrimSpace(fields[1]),
+				Repo:             strings.TrimSpace(fields[2]),
+				InstallationType: utility.ParseInstallationName(fields[3]),
+				// Add other properties as needed
+			})
 		}
+	}
 
-		if err := scanner.Err(); err != nil {
-		    log.Fatalf("Error scanning permission output:", err)
+	// Get permissions (all) for installed applications
+	for i, app := range apps {
+		apps[i].All, err = getMetadataFromCLI(ctx, app)
+		if err != nil {
+			warnings = append(warnings, &SystemStateError{Part: PartMetadata, Target: app.Name, Err: err})
 		}
+	}
+	return apps, warnings, nil
+}
 
-		if err := permissionsCmd.Wait(); err != nil {
-		    log.Fatalf("Error waiting for command:", err)
-		}
-    	}
+// getMetadataFromCLI reads the metadata of an installed application with flatpak info -M
+// and returns its permissions as override flags
+func getMetadataFromCLI(ctx context.Context, app model.FlatpakApplication) ([]string, error) {
+	args := []string{"info", utility.InstallationFlag(app.InstallationType), "-M", app.Name}
+	if app.Branch != "" {
+		args = append(args, app.Branch)
+	}
+	permissionsOutput, err := exec.CommandContext(ctx, "flatpak", args...).Output()
+	if err != nil {
+		return nil, err
+	}
+	return utility.MapPermissionsToFlatpakOverrideFlags(string(permissionsOutput))
+}
 
-	return currentState
+// getOverrides reads the override file of an application, or the global one, in the installation
+// used by flatpak override (system or user). flatpak override --show is used when the file cannot be read.
+func getOverrides(ctx context.Context, installation utility.Installation, appID string) ([]string, error) {
+	overrides, err := utility.ReadOverrides(installation, appID)
+	if err == nil {
+		return overrides, nil
+	}
+	if utility.Root() != "" {
+		return nil, &SystemStateError{Part: PartOverrides, Target: appID, Err: err}
+	}
+	args := []string{"override", "--show", utility.InstallationFlag(installation.ID)}
+	if appID != utility.GlobalOverride {
+		args = append(args, appID)
+	}
+	permissionsOutput, err := exec.CommandContext(ctx, "flatpak", args...).Output()
+	if err != nil {
+		return nil, &SystemStateError{Part: PartOverrides, Target: appID, Err: err}
+	}
+	overrides, err = utility.ParseFlatpakPermissions(string(permissionsOutput))
+	if err != nil {
+		return nil, &SystemStateError{Part: PartOverrides, Target: appID, Err: err}
+	}
+	return overrides, nil
 }
 
+// systemScopeInstallation returns the installation holding the system overrides of an application:
+// its own installation when it is a custom one, the default system installation otherwise
+func systemScopeInstallation(app model.FlatpakApplication, installations []utility.Installation) utility.Installation {
+	for _, installation := range installations {
+		if installation.ID == app.InstallationType && installation.ID != utility.UserInstallationType {
+			return installation
+		}
+	}
+	return utility.SystemInstallation()
+}
+
+// isMasked reports whether the updates of an application are masked in its installation.
+// Masks are stored as a list of patterns in the xa.masked option of the repo config.
+func isMasked(app model.FlatpakApplication, envs []model.Environment) bool {
+	for _, env := range envs {
+		if env.InstallationType != app.InstallationType {
+			continue
+		}
+		for _, pattern := range strings.Split(env.Core["xa.masked"], ";") {
+			if pattern == app.Name || pattern == app.Name+"//"+app.Branch {
+				return true
+			}
+		}
+	}
+	return false
+}
 
 func parsePermission(line string) (model.Permission, error) {
     /*parts := strings.Fields(line)
@@ -0,0 +1,137 @@
+package state
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// Update is an installed ref with an available update
+type Update struct {
+	Ref              string // <id>/<arch>/<branch> of an application or a runtime
+	InstallationType string
+	Reason           string // Application and update policy that requested the update
+}
+
+// getAvailableUpdates returns the refs with an available update in an installation
+func getAvailableUpdates(installationType string) ([]string, error) {
+	output, err := exec.Command("flatpak", "remote-ls", "--updates", utility.InstallationFlag(installationType), "--columns=ref").Output()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get the available updates of the %s installation: %w", installationType, err)
+	}
+	var refs []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if ref := strings.TrimSpace(line); ref != "" {
+			refs = append(refs, partialRef(ref))
+		}
+	}
+	return refs, nil
+}
+
+// getApplicationRuntime returns the runtime of an installed application as <id>/<arch>/<branch>
+func getApplicationRuntime(app model.FlatpakApplication) (string, error) {
+	output, err := exec.Command("flatpak", "info", utility.InstallationFlag(app.InstallationType), "--show-runtime", app.Name).Output()
+	if err != nil {
+		return "", fmt.Errorf("cannot get the runtime of %s: %w", app.Name, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// GetUpdates returns the available updates of the managed applications whose update policy is in policies.
+// Applications with the security-only policy get the updates of their runtime only.
+// Applications that are not in the compose file are never updated.
+// Listing the available updates queries the remotes, an error is returned when it fails.
+func GetUpdates(currentState, nextState model.State, policies ...string) ([]Update, error) {
+	var updates []Update
+	available := make(map[string][]string)
+	added := make(map[string]bool)
+
+	// Runtimes can be installed in another installation than the application,
+	// the installation of the application is searched first, like flatpak does
+	findRuntime := func(ref, appInstallation string) (string, bool) {
+		installationTypes := []string{appInstallation}
+		var others []string
+		for installationType := range available {
+			if installationType != appInstallation {
+				others = append(others, installationType)
+			}
+		}
+		sort.Strings(others)
+		for _, installationType := range append(installationTypes, others...) {
+			for _, r := range available[installationType] {
+				if r == ref {
+					return installationType, true
+				}
+			}
+		}
+		return "", false
+	}
+	listUpdates := func(installationType string) error {
+		if _, exists := available[installationType]; exists {
+			return nil
+		}
+		refs, err := getAvailableUpdates(installationType)
+		if err != nil {
+			return err
+		}
+		available[installationType] = refs
+		return nil
+	}
+
+	for _, nextApp := range nextState.Applications {
+		if !StringExistsInArray(defaultUpdatePolicy(nextApp.UpdatePolicy), policies) {
+			continue
+		}
+		installed := false
+		var currentApp model.FlatpakApplication
+		for _, app := range currentState.Applications {
+			if sameApplication(app, nextApp) {
+				installed, currentApp = true, app
+				break
+			}
+		}
+		if !installed {
+			continue
+		}
+		for _, env := range currentState.Environment {
+			if err := listUpdates(env.InstallationType); err != nil {
+				return updates, err
+			}
+		}
+		if err := listUpdates(currentApp.InstallationType); err != nil {
+			return updates, err
+		}
+
+		reason := nextApp.Name + " (" + defaultUpdatePolicy(nextApp.UpdatePolicy) + ")"
+		if nextApp.UpdatePolicy == model.UpdatePolicySecurityOnly {
+			runtimeRef, err := getApplicationRuntime(currentApp)
+			if err != nil {
+				return updates, err
+			}
+			if installationType, ok := findRuntime(runtimeRef, currentApp.InstallationType); ok && !added[installationType+"|"+runtimeRef] {
+				added[installationType+"|"+runtimeRef] = true
+				updates = append(updates, Update{Ref: runtimeRef, InstallationType: installationType, Reason: reason})
+			}
+			continue
+		}
+		for _, ref := range available[currentApp.InstallationType] {
+			parts := strings.Split(ref, "/")
+			if len(parts) == 3 && parts[0] == currentApp.Name && parts[2] == currentApp.Branch && !added[currentApp.InstallationType+"|"+ref] {
+				added[currentApp.InstallationType+"|"+ref] = true
+				updates = append(updates, Update{Ref: ref, InstallationType: currentApp.InstallationType, Reason: reason})
+			}
+		}
+	}
+	return updates, nil
+}
+
+// defaultUpdatePolicy returns the effective update policy
+func defaultUpdatePolicy(policy string) string {
+	if policy == "" {
+		return model.UpdatePolicyManual
+	}
+	return policy
+}
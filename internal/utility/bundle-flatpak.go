@@ -0,0 +1,59 @@
+package utility
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadBundleRef reads the ref (app/<id>/<arch>/<branch>) of a single-file bundle.
+// A bundle is an OSTree static delta superblock, a GVariant tuple starting with its
+// a{sv} metadata. Only the metadata is read, bundles hold the whole application.
+func ReadBundleRef(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	// The framing offsets of the tuple are stored in reverse order, the last one ends the metadata
+	size := int(info.Size())
+	offsetSize := gvariantOffsetSize(size)
+	if size < offsetSize {
+		return "", fmt.Errorf("invalid bundle: file too short")
+	}
+	offset := make([]byte, offsetSize)
+	if _, err := file.ReadAt(offset, int64(size-offsetSize)); err != nil {
+		return "", err
+	}
+	end := readGVariantOffset(offset, offsetSize)
+	if end > size-offsetSize {
+		return "", fmt.Errorf("invalid bundle: metadata offset out of range")
+	}
+	data := make([]byte, end)
+	if _, err := io.ReadFull(file, data); err != nil {
+		return "", err
+	}
+
+	value, err := ParseGVariant("a{sv}", data)
+	if err != nil {
+		return "", fmt.Errorf("invalid bundle metadata: %w", err)
+	}
+	for _, entry := range value.([]interface{}) {
+		pair := entry.([]interface{})
+		if pair[0] != "ref" {
+			continue
+		}
+		ref, _ := pair[1].(string)
+		if len(strings.Split(ref, "/")) != 4 {
+			return "", fmt.Errorf("invalid bundle ref: %s", ref)
+		}
+		return ref, nil
+	}
+	return "", fmt.Errorf("missing ref in bundle metadata")
+}
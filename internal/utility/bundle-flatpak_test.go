@@ -0,0 +1,45 @@
+package utility
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testdata/bundle.flatpak was serialized by GLib with the metadata of a bundle first,
+// its size needs 2 byte framing offsets
+func TestReadBundleRef(t *testing.T) {
+	ref, err := ReadBundleRef("testdata/bundle.flatpak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref != "app/org.example.App/x86_64/master" {
+		t.Errorf("got %q", ref)
+	}
+
+	data, err := os.ReadFile("testdata/bundle.flatpak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ({'origin': <'x'>}, @ay [1]) serialized by GLib
+	noRef, _ := hex.DecodeString("6f726967696e000078000073070d010e")
+	invalid := map[string][]byte{
+		"empty":     {},
+		"truncated": data[:len(data)-10],
+		"no ref":    noRef,
+	}
+	dir := t.TempDir()
+	for name, content := range invalid {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if ref, err := ReadBundleRef(path); err == nil {
+			t.Errorf("%s: no error, got %q", name, ref)
+		}
+	}
+	if _, err := ReadBundleRef(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
@@ -0,0 +1,122 @@
+package utility
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Kinds of deployed refs
+const (
+	AppKind     = "app"
+	RuntimeKind = "runtime"
+)
+
+// deployDataType is the GVariant type of the deploy file: origin, commit, subpaths, installed size and metadata
+const deployDataType = "(ssasta{sv})"
+
+// DeployData is the content of the deploy file of a deployed ref
+type DeployData struct {
+	Origin        string
+	Commit        string
+	SubPaths      []string
+	InstalledSize uint64
+	Metadata      map[string]interface{} // appdata-name, appdata-version, eol, eolr, ...
+}
+
+// MetadataString returns a string value of the deploy metadata, empty if missing
+func (d DeployData) MetadataString(key string) string {
+	value, _ := d.Metadata[key].(string)
+	return value
+}
+
+// ParseDeployData decodes a deploy file
+func ParseDeployData(data []byte) (DeployData, error) {
+	var deploy DeployData
+	value, err := ParseGVariant(deployDataType, data)
+	if err != nil {
+		return deploy, err
+	}
+	fields := value.([]interface{})
+	deploy.Origin = fields[0].(string)
+	deploy.Commit = fields[1].(string)
+	for _, subPath := range fields[2].([]interface{}) {
+		deploy.SubPaths = append(deploy.SubPaths, subPath.(string))
+	}
+	// flatpak stores the installed size big-endian (GUINT64_TO_BE) inside the little-endian variant
+	deploy.InstalledSize = bits.ReverseBytes64(fields[3].(uint64))
+	deploy.Metadata = make(map[string]interface{})
+	for _, entry := range fields[4].([]interface{}) {
+		pair := entry.([]interface{})
+		deploy.Metadata[pair[0].(string)] = pair[1]
+	}
+	return deploy, nil
+}
+
+// Deployment is a ref deployed in an installation, <installation>/<kind>/<id>/<arch>/<branch>/active
+type Deployment struct {
+	Kind         string
+	ID           string
+	Arch         string
+	Branch       string
+	Installation string // Installation type
+	Dir          string // Active deploy directory
+}
+
+// GetDeployments returns the refs of a kind (app or runtime) deployed in an installation.
+// A missing kind directory means that nothing is deployed.
+func GetDeployments(installation Installation, kind string) ([]Deployment, error) {
+	// Glob ignores the read errors, an unreadable installation would look empty
+	if _, err := os.ReadDir(filepath.Join(installation.Path, kind)); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	dirs, err := filepath.Glob(filepath.Join(installation.Path, kind, "*", "*", "*", "active"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+
+	var deployments []Deployment
+	for _, dir := range dirs {
+		branchDir := filepath.Dir(dir)
+		archDir := filepath.Dir(branchDir)
+		deployments = append(deployments, Deployment{
+			Kind:         kind,
+			ID:           filepath.Base(filepath.Dir(archDir)),
+			Arch:         filepath.Base(archDir),
+			Branch:       filepath.Base(branchDir),
+			Installation: installation.ID,
+			Dir:          dir,
+		})
+	}
+	return deployments, nil
+}
+
+// Ref returns the full ref of the deployment, kind/id/arch/branch
+func (d Deployment) Ref() string {
+	return fmt.Sprintf("%s/%s/%s/%s", d.Kind, d.ID, d.Arch, d.Branch)
+}
+
+// ReadDeployData reads the deploy file of the deployment
+func (d Deployment) ReadDeployData() (DeployData, error) {
+	data, err := os.ReadFile(filepath.Join(d.Dir, "deploy"))
+	if err != nil {
+		return DeployData{}, err
+	}
+	deploy, err := ParseDeployData(data)
+	if err != nil {
+		return deploy, fmt.Errorf("invalid deploy file: %w", err)
+	}
+	return deploy, nil
+}
+
+// ReadMetadata reads the metadata keyfile of the deployment, the content shown by flatpak info -M
+func (d Deployment) ReadMetadata() (string, error) {
+	data, err := os.ReadFile(filepath.Join(d.Dir, "metadata"))
+	return string(data), err
+}
@@ -0,0 +1,85 @@
+package utility
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// The deploy files in testdata were serialized by GLib with the layout written by flatpak,
+// deploy-app is larger than 255 bytes and uses 2 byte framing offsets
+func TestParseDeployData(t *testing.T) {
+	data, err := os.ReadFile("testdata/deploy-app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := ParseDeployData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.Origin != "flathub" {
+		t.Errorf("origin: %q", deploy.Origin)
+	}
+	if deploy.Commit != "2f3c0a9d8e7b6a5f4e3d2c1b0a9f8e7d6c5b4a3f2e1d0c9b8a7f6e5d4c3b2a19" {
+		t.Errorf("commit: %q", deploy.Commit)
+	}
+	if len(deploy.SubPaths) != 0 {
+		t.Errorf("subpaths: %q", deploy.SubPaths)
+	}
+	if deploy.InstalledSize != 52428800 {
+		t.Errorf("installed size: %d", deploy.InstalledSize)
+	}
+	for key, want := range map[string]string{
+		"appdata-name":    "Calculator",
+		"appdata-version": "46.1",
+		"appdata-license": "GPL-3.0-or-later",
+		"eol":             "",
+	} {
+		if got := deploy.MetadataString(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if got := deploy.Metadata["deploy-version"]; got != int32(4) {
+		t.Errorf("deploy-version: %#v", got)
+	}
+	if got := deploy.Metadata["timestamp"]; got != uint64(1709287200) {
+		t.Errorf("timestamp: %#v", got)
+	}
+	if got := deploy.Metadata["previous-ids"]; !reflect.DeepEqual(got, []interface{}{"org.gnome.Calculator.Old"}) {
+		t.Errorf("previous-ids: %#v", got)
+	}
+	rating := []interface{}{"oars-1.1", []interface{}{[]interface{}{"violence-cartoon", "mild"}}}
+	if got := deploy.Metadata["appdata-content-rating"]; !reflect.DeepEqual(got, rating) {
+		t.Errorf("appdata-content-rating: %#v", got)
+	}
+}
+
+func TestParseDeployDataEndOfLife(t *testing.T) {
+	data, err := os.ReadFile("testdata/deploy-eol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deploy, err := ParseDeployData(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deploy.Origin != "fedora" || deploy.Commit != "aa11" {
+		t.Errorf("origin and commit: %q %q", deploy.Origin, deploy.Commit)
+	}
+	if !reflect.DeepEqual(deploy.SubPaths, []string{"/de", "/en"}) {
+		t.Errorf("subpaths: %q", deploy.SubPaths)
+	}
+	if deploy.InstalledSize != 256 {
+		t.Errorf("installed size: %d", deploy.InstalledSize)
+	}
+	if got := deploy.MetadataString("eol"); got != "This branch is no longer supported" {
+		t.Errorf("eol: %q", got)
+	}
+	if got := deploy.MetadataString("eolr"); got != "app/org.example.New/x86_64/stable" {
+		t.Errorf("eolr: %q", got)
+	}
+
+	if _, err := ParseDeployData(data[:len(data)/2]); err == nil {
+		t.Error("truncated deploy file: no error")
+	}
+}
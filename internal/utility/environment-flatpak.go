@@ -1,13 +1,12 @@
 package utility 
 
 import (
-	"fmt"
 	"os"
-	"bufio"
 	"strings"
 	"errors"
 	"encoding/base64" 
 	"io/ioutil"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
 	"github.com/faan11/flatpak-compose/internal/model"
 )
 
@@ -22,108 +21,73 @@ func ParseEnvironment(file_path string) (model.Environment, error) {
 	config.Core = make(map[string]string)
 	config.Remotes = make(map[string]map[string]string)
 
-	file, err := os.Open(file_path + "/config")
+	k, err := keyfile.ReadFile(file_path + "/config")
 	if err != nil {
 		return model.Environment{}, err
 	}
-	defer file.Close()
 
+	for _, group := range k.Groups() {
+		values := make(map[string]string)
+		for _, key := range k.Keys(group) {
+			values[key], _ = k.String(group, key)
+		}
 
-	var currentSectionValue string
-	var currentSectionName string
-	var remoteData map[string]string
-	var newSectionValue string
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-
-		if line == "" || strings.HasPrefix(line, "#") {
+		if group == "core" {
+			config.Core = values
 			continue
 		}
-
-		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
-			newSection := strings.TrimSpace(line[1 : len(line)-1])
-			newSectionFields := strings.SplitN(newSection, " ", 2)
-			newSectionName := newSectionFields[0]
-			if (len(newSectionFields) == 2){
-				newSectionValue = strings.Trim(newSectionFields[1],"\"")
-			}
-
-			if newSectionName == "remote" {
-				if (currentSectionName == "remote") {
-					config.Remotes[currentSectionValue] = remoteData
-				}
-				currentSectionName = newSectionName
-				currentSectionValue = newSectionValue	
-				remoteData = make(map[string]string)
-				
-				gpgKeyFilePath := file_path + "/"+ newSectionValue +".trustedkeys.gpg"	
-				// Check gpg file existence
-				if checkFileExists(gpgKeyFilePath) {
-					// read the whole
-					gpgData, err := ioutil.ReadFile(gpgKeyFilePath)
-					if err != nil {
-						return model.Environment{}, err
-					}
-					// Convert it to base64
-					encodedString := base64.StdEncoding.EncodeToString(gpgData)
-					// Assign it to GPGKey label
-					remoteData["GPGKey"] = encodedString
-				} else {
-					remoteData["GPGKey"] = ""
-				}
-			} else {
-				// it's core
-				currentSectionName = newSectionName
+		// Remote groups are named remote "<name>"
+		if !strings.HasPrefix(group, "remote \"") || !strings.HasSuffix(group, "\"") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(group, "remote \""), "\"")
+
+		gpgKeyFilePath := file_path + "/"+ name +".trustedkeys.gpg"
+		// Check gpg file existence
+		if checkFileExists(gpgKeyFilePath) {
+			// read the whole
+			gpgData, err := ioutil.ReadFile(gpgKeyFilePath)
+			if err != nil {
+				return model.Environment{}, err
 			}
+			// Convert it to base64
+			encodedString := base64.StdEncoding.EncodeToString(gpgData)
+			// Assign it to GPGKey label
+			values["GPGKey"] = encodedString
 		} else {
-
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) != 2 {
-				return model.Environment{}, fmt.Errorf("malformed line: %s", line)
-			}
-
-			key := strings.TrimSpace(parts[0])
-			value := strings.TrimSpace(parts[1])
-
-			if currentSectionName == "core" {
-				config.Core[key] = value
-			} else if currentSectionName == "remote" {
-				remoteData[key] = value
-			}
+			values["GPGKey"] = ""
 		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		return model.Environment{}, err
-	}
-
-	if len(remoteData) > 0 {
-		config.Remotes[currentSectionValue] = remoteData
+		config.Remotes[name] = values
 	}
 
 	return config, nil
 }
 
-func GetUserEnvironment() (model.Environment, error){
-	repo_path := os.Getenv("HOME") + "/.local/share/flatpak/repo"
-	config, err := ParseEnvironment(repo_path)
+// GetInstallationEnvironment reads the repo config of an installation.
+// An installation that does not exist yet, such as the user installation of a
+// user that never installed anything, has an empty environment.
+func GetInstallationEnvironment(installation Installation) (model.Environment, error){
+	config, err := ParseEnvironment(installation.Path + "/repo")
+	if errors.Is(err, os.ErrNotExist) {
+		return model.Environment{
+			Core:             make(map[string]string),
+			Remotes:          make(map[string]map[string]string),
+			InstallationType: installation.ID,
+		}, nil
+	}
 	if err != nil {
 		return model.Environment{}, err
 	}
-	config.InstallationType = "user"
+	config.InstallationType = installation.ID
 	return config, err
 }
 
+func GetUserEnvironment() (model.Environment, error){
+	return GetInstallationEnvironment(UserInstallation())
+}
+
 func GetSystemEnvironment() (model.Environment, error){
-	repo_path := "/var/lib/flatpak/repo" 
-	config, err := ParseEnvironment(repo_path)
-	if err != nil {
-		return model.Environment{}, err
-	}
-	config.InstallationType = "system"
-	return config, err
+	return GetInstallationEnvironment(SystemInstallation())
 }
 /*
 func main() {
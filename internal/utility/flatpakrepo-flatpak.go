@@ -0,0 +1,86 @@
+package utility
+
+import (
+	"fmt"
+	"os"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
+)
+
+// flatpakRepoKeys maps the [Flatpak Repo] keys to the remote options of the repo config
+var flatpakRepoKeys = map[string]string{
+	"Title":         "xa.title",
+	"Url":           "url",
+	"Homepage":      "xa.homepage",
+	"Comment":       "xa.comment",
+	"Description":   "xa.description",
+	"Icon":          "xa.icon",
+	"GPGKey":        "GPGKey",
+	"DefaultBranch": "xa.default-branch",
+	"CollectionID":  "collection-id",
+}
+
+// parseKeyFileGroup returns the keys of a group of a .flatpakrepo/.flatpakref file
+func parseKeyFileGroup(content string, group string) (map[string]string, error) {
+	k, err := keyfile.Parse([]byte(content))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, key := range k.Keys(group) {
+		values[key], _ = k.String(group, key)
+	}
+	return values, nil
+}
+
+// ParseFlatpakRepo parses the content of a .flatpakrepo file and returns the remote options,
+// using the same keys as a remote of the repo config.
+func ParseFlatpakRepo(content string) (map[string]string, error) {
+	values, err := parseKeyFileGroup(content, "Flatpak Repo")
+	if err != nil {
+		return nil, err
+	}
+	remote := make(map[string]string)
+	for key, value := range values {
+		if option, ok := flatpakRepoKeys[key]; ok {
+			remote[option] = value
+		}
+	}
+
+	if _, ok := remote["url"]; !ok {
+		return nil, fmt.Errorf("missing Url in [Flatpak Repo] section")
+	}
+	// flatpak enables the signature verification only when the file provides a key
+	if remote["GPGKey"] != "" {
+		remote["gpg-verify"] = "true"
+		remote["gpg-verify-summary"] = "true"
+	} else {
+		remote["gpg-verify"] = "false"
+		remote["gpg-verify-summary"] = "false"
+	}
+	return remote, nil
+}
+
+// ReadFlatpakRepoFile reads and parses a .flatpakrepo file
+func ReadFlatpakRepoFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseFlatpakRepo(string(content))
+}
+
+// ReadFlatpakRefFile reads a .flatpakref file and returns the keys of the [Flatpak Ref] group
+func ReadFlatpakRefFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := parseKeyFileGroup(string(content), "Flatpak Ref")
+	if err != nil {
+		return nil, err
+	}
+	if ref["Name"] == "" {
+		return nil, fmt.Errorf("missing Name in [Flatpak Ref] section")
+	}
+	return ref, nil
+}
@@ -0,0 +1,197 @@
+package utility
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const packetTagPublicKey = 6
+
+// ReadGPGKeyFile reads a binary (.gpg) or ASCII armored (.asc) key file and returns the binary keyring
+func ReadGPGKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		return dearmor(data)
+	}
+	return data, nil
+}
+
+// dearmor decodes an ASCII armored OpenPGP block
+func dearmor(data []byte) ([]byte, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	var body strings.Builder
+	inBlock, inHeaders := false, false
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "-----BEGIN PGP"):
+			inBlock, inHeaders = true, true
+		case strings.HasPrefix(line, "-----END PGP"):
+			inBlock = false
+		case !inBlock:
+		case inHeaders:
+			// Armor headers (e.g. "Version: ...") end with an empty line
+			if line == "" {
+				inHeaders = false
+			} else if !strings.Contains(line, ":") {
+				inHeaders = false
+				body.WriteString(line)
+			}
+		case strings.HasPrefix(line, "="):
+			// CRC24 checksum line
+		default:
+			body.WriteString(line)
+		}
+	}
+	decoded, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid armored key: %w", err)
+	}
+	return decoded, nil
+}
+
+// GPGKeyFingerprints returns the sorted fingerprints of the primary keys contained in a binary keyring
+func GPGKeyFingerprints(data []byte) ([]string, error) {
+	var fingerprints []string
+	for len(data) > 0 {
+		tag, body, rest, err := readPacket(data)
+		if err != nil {
+			return nil, err
+		}
+		data = rest
+		if tag != packetTagPublicKey {
+			continue
+		}
+		fingerprint, err := keyFingerprint(tag, body)
+		if err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	sort.Strings(fingerprints)
+	return fingerprints, nil
+}
+
+// SameGPGKey reports whether two base64 encoded keyrings contain the same keys.
+// Keyrings written by ostree carry trust packets, so the raw data is not comparable.
+func SameGPGKey(a, b string) bool {
+	if a == b {
+		return true
+	}
+	fa, errA := base64GPGKeyFingerprints(a)
+	fb, errB := base64GPGKeyFingerprints(b)
+	if errA != nil || errB != nil || len(fa) == 0 || len(fa) != len(fb) {
+		return false
+	}
+	for i := range fa {
+		if fa[i] != fb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func base64GPGKeyFingerprints(encoded string) ([]string, error) {
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return GPGKeyFingerprints(data)
+}
+
+// readPacket splits the first OpenPGP packet from data
+func readPacket(data []byte) (tag int, body, rest []byte, err error) {
+	header := data[0]
+	if header&0x80 == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid OpenPGP packet header: 0x%02x", header)
+	}
+	var length, offset int
+	if header&0x40 != 0 {
+		// New format packet
+		tag = int(header & 0x3f)
+		if len(data) < 2 {
+			return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+		}
+		switch first := int(data[1]); {
+		case first < 192:
+			length, offset = first, 2
+		case first < 224:
+			if len(data) < 3 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = ((first-192)<<8)+int(data[2])+192, 3
+		case first == 255:
+			if len(data) < 6 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[2:6])), 6
+		default:
+			return 0, nil, nil, fmt.Errorf("partial OpenPGP packets are not supported in keyrings")
+		}
+	} else {
+		// Old format packet
+		tag = int(header>>2) & 0x0f
+		switch header & 0x03 {
+		case 0:
+			if len(data) < 2 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(data[1]), 2
+		case 1:
+			if len(data) < 3 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint16(data[1:3])), 3
+		case 2:
+			if len(data) < 5 {
+				return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+			}
+			length, offset = int(binary.BigEndian.Uint32(data[1:5])), 5
+		default:
+			length, offset = len(data)-1, 1
+		}
+	}
+	if offset+length > len(data) {
+		return 0, nil, nil, fmt.Errorf("truncated OpenPGP packet")
+	}
+	return tag, data[offset : offset+length], data[offset+length:], nil
+}
+
+// keyFingerprint computes the fingerprint of a public key packet body (RFC 4880 / RFC 9580)
+func keyFingerprint(tag int, body []byte) (string, error) {
+	if len(body) == 0 {
+		return "", fmt.Errorf("empty OpenPGP key packet")
+	}
+	switch body[0] {
+	case 4:
+		h := sha1.New()
+		h.Write([]byte{0x99, byte(len(body) >> 8), byte(len(body))})
+		h.Write(body)
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+	case 5, 6:
+		prefix := byte(0x9a)
+		if body[0] == 6 {
+			prefix = 0x9b
+		}
+		h := sha256.New()
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(body)))
+		h.Write([]byte{prefix})
+		h.Write(size)
+		h.Write(body)
+		return strings.ToUpper(hex.EncodeToString(h.Sum(nil))), nil
+	default:
+		return "", fmt.Errorf("unsupported OpenPGP key version %d in packet %d", body[0], tag)
+	}
+}
@@ -0,0 +1,120 @@
+package utility
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// Fingerprints of the keys in testdata, as printed by gpg --fingerprint for the v4 keys
+// and computed with sha256 over 0x9a/0x9b, the 4 byte length and the packet body for v5 and v6
+const (
+	ed25519Fingerprint = "EAFE439DE4D2845290A8F1E324CCD2AB0B9E995C"
+	rsaFingerprint     = "9941FACBEF13CC173EF1AB7C388C06190D0CE0AD"
+	v5Fingerprint      = "E5D77CF850E1A64ED15EE85C737D7459BDF064288B6FD921D853BC0688BC6C20"
+	v6Fingerprint      = "F0FF26E87A94CB93C38D1FA99962FCE01974F2E7AFDE4AF1748474D02AA054A5"
+)
+
+// The v4 keys were exported by gpg, which writes old format packets, and rewritten with the other
+// headers. Each keyring holds the public key, a user ID and a signature packet.
+func TestGPGKeyFingerprints(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"testdata/gpg-v4-old-1byte.gpg", ed25519Fingerprint},
+		{"testdata/gpg-v4-old-2byte.asc", rsaFingerprint},
+		{"testdata/gpg-v4-old-4byte.gpg", ed25519Fingerprint},
+		{"testdata/gpg-v4-new-2byte.gpg", rsaFingerprint},
+		{"testdata/gpg-v4-new-5byte.gpg", ed25519Fingerprint},
+		{"testdata/gpg-v5.gpg", v5Fingerprint},
+		{"testdata/gpg-v6.gpg", v6Fingerprint},
+	}
+	for _, test := range tests {
+		data, err := ReadGPGKeyFile(test.file)
+		if err != nil {
+			t.Fatalf("%s: %v", test.file, err)
+		}
+		got, err := GPGKeyFingerprints(data)
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, []string{test.want}) {
+			t.Errorf("%s: got %q, want %q", test.file, got, test.want)
+		}
+	}
+
+	// Keyrings with several keys are sorted
+	rsa, _ := ReadGPGKeyFile("testdata/gpg-v4-new-2byte.gpg")
+	ed25519, _ := ReadGPGKeyFile("testdata/gpg-v4-old-1byte.gpg")
+	got, err := GPGKeyFingerprints(append(append([]byte{}, ed25519...), rsa...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{rsaFingerprint, ed25519Fingerprint}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keyring: got %q, want %q", got, want)
+	}
+}
+
+func TestGPGKeyFingerprintsErrors(t *testing.T) {
+	ed25519, err := ReadGPGKeyFile("testdata/gpg-v4-old-1byte.gpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not a packet header", "00"},
+		{"truncated new format length", "c6"},
+		{"truncated 2 byte length", "c6c0"},
+		{"truncated 5 byte length", "c6ff0000"},
+		{"partial body length", "c6e1" + hex.EncodeToString(ed25519[2:4])},
+		{"truncated old format length", "99"},
+		{"truncated body", hex.EncodeToString(ed25519[:20])},
+		{"empty key packet", "9800"},
+		{"unsupported key version", "9802035a"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := GPGKeyFingerprints(data); err == nil {
+			t.Errorf("%s: no error, got %q", test.name, got)
+		}
+	}
+
+	if _, err := dearmor([]byte("-----BEGIN PGP PUBLIC KEY BLOCK-----\n\n!!!\n-----END PGP PUBLIC KEY BLOCK-----\n")); err == nil {
+		t.Error("invalid armor: no error")
+	}
+}
+
+func TestSameGPGKey(t *testing.T) {
+	encoded := make(map[string]string)
+	for _, file := range []string{"gpg-v4-old-1byte.gpg", "gpg-v4-new-5byte.gpg", "gpg-v4-old-2byte.asc", "gpg-v4-new-2byte.gpg"} {
+		data, err := ReadGPGKeyFile("testdata/" + file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded[file] = base64.StdEncoding.EncodeToString(data)
+	}
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"gpg-v4-old-1byte.gpg", "gpg-v4-new-5byte.gpg", true},
+		{"gpg-v4-old-2byte.asc", "gpg-v4-new-2byte.gpg", true},
+		{"gpg-v4-old-1byte.gpg", "gpg-v4-new-2byte.gpg", false},
+	}
+	for _, test := range tests {
+		if got := SameGPGKey(encoded[test.a], encoded[test.b]); got != test.want {
+			t.Errorf("%s and %s: got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+	if SameGPGKey(encoded["gpg-v4-old-1byte.gpg"], "not base64") {
+		t.Error("invalid keyring is the same key")
+	}
+}
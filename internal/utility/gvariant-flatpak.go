@@ -0,0 +1,250 @@
+package utility
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// gvariantType describes a GVariant type string, such as "(ssasta{sv})"
+type gvariantType struct {
+	code      byte           // Type code, '(' for tuples and '{' for dictionary entries
+	elem      *gvariantType  // Element of arrays
+	members   []gvariantType // Members of tuples and dictionary entries
+	alignment int
+	fixedSize int // 0 when the size is variable
+}
+
+// parseGVariantType parses the first complete type of a type string and returns the rest of it
+func parseGVariantType(s string) (gvariantType, string, error) {
+	if s == "" {
+		return gvariantType{}, "", fmt.Errorf("empty gvariant type")
+	}
+	switch c := s[0]; c {
+	case 'y', 'b':
+		return gvariantType{code: c, alignment: 1, fixedSize: 1}, s[1:], nil
+	case 'n', 'q':
+		return gvariantType{code: c, alignment: 2, fixedSize: 2}, s[1:], nil
+	case 'i', 'u', 'h':
+		return gvariantType{code: c, alignment: 4, fixedSize: 4}, s[1:], nil
+	case 'x', 't', 'd':
+		return gvariantType{code: c, alignment: 8, fixedSize: 8}, s[1:], nil
+	case 's', 'o', 'g':
+		return gvariantType{code: c, alignment: 1}, s[1:], nil
+	case 'v':
+		return gvariantType{code: c, alignment: 8}, s[1:], nil
+	case 'a':
+		elem, rest, err := parseGVariantType(s[1:])
+		if err != nil {
+			return gvariantType{}, "", err
+		}
+		return gvariantType{code: c, elem: &elem, alignment: elem.alignment}, rest, nil
+	case '(', '{':
+		end := byte(')')
+		if c == '{' {
+			end = '}'
+		}
+		t := gvariantType{code: c, alignment: 1}
+		rest := s[1:]
+		for {
+			if rest == "" {
+				return gvariantType{}, "", fmt.Errorf("unterminated gvariant type: %s", s)
+			}
+			if rest[0] == end {
+				rest = rest[1:]
+				break
+			}
+			member, next, err := parseGVariantType(rest)
+			if err != nil {
+				return gvariantType{}, "", err
+			}
+			t.members = append(t.members, member)
+			if member.alignment > t.alignment {
+				t.alignment = member.alignment
+			}
+			rest = next
+		}
+		if c == '{' && len(t.members) != 2 {
+			return gvariantType{}, "", fmt.Errorf("dictionary entry must have two members: %s", s)
+		}
+		// A tuple has a fixed size when all the members have one
+		size := 0
+		for _, member := range t.members {
+			if member.fixedSize == 0 {
+				return t, rest, nil
+			}
+			size = alignGVariant(size, member.alignment) + member.fixedSize
+		}
+		if size == 0 {
+			t.fixedSize = 1
+		} else {
+			t.fixedSize = alignGVariant(size, t.alignment)
+		}
+		return t, rest, nil
+	}
+	return gvariantType{}, "", fmt.Errorf("unsupported gvariant type: %s", s)
+}
+
+func alignGVariant(offset, alignment int) int {
+	return (offset + alignment - 1) / alignment * alignment
+}
+
+// gvariantOffsetSize returns the size of the framing offsets of a container
+func gvariantOffsetSize(size int) int {
+	switch {
+	case size == 0:
+		return 0
+	case size <= math.MaxUint8:
+		return 1
+	case size <= math.MaxUint16:
+		return 2
+	case uint64(size) <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+// readGVariantOffset reads a little-endian framing offset
+func readGVariantOffset(data []byte, size int) int {
+	var offset uint64
+	for i := size - 1; i >= 0; i-- {
+		offset = offset<<8 | uint64(data[i])
+	}
+	return int(offset)
+}
+
+// ParseGVariant decodes a little-endian serialized GVariant of the given type.
+// Strings are returned as string, integers with their Go type, arrays, tuples and
+// dictionary entries as []interface{} and variants as their value.
+// Maybe types are not supported.
+func ParseGVariant(typeString string, data []byte) (interface{}, error) {
+	t, rest, err := parseGVariantType(typeString)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid gvariant type: %s", typeString)
+	}
+	return decodeGVariant(t, data)
+}
+
+func decodeGVariant(t gvariantType, data []byte) (interface{}, error) {
+	if t.fixedSize != 0 && len(data) != t.fixedSize {
+		return nil, fmt.Errorf("gvariant '%c' has size %d instead of %d", t.code, len(data), t.fixedSize)
+	}
+	switch t.code {
+	case 'y':
+		return data[0], nil
+	case 'b':
+		return data[0] != 0, nil
+	case 'n':
+		return int16(binary.LittleEndian.Uint16(data)), nil
+	case 'q':
+		return binary.LittleEndian.Uint16(data), nil
+	case 'i', 'h':
+		return int32(binary.LittleEndian.Uint32(data)), nil
+	case 'u':
+		return binary.LittleEndian.Uint32(data), nil
+	case 'x':
+		return int64(binary.LittleEndian.Uint64(data)), nil
+	case 't':
+		return binary.LittleEndian.Uint64(data), nil
+	case 'd':
+		return math.Float64frombits(binary.LittleEndian.Uint64(data)), nil
+	case 's', 'o', 'g':
+		if len(data) == 0 || data[len(data)-1] != 0 {
+			return nil, fmt.Errorf("gvariant string is not nul terminated")
+		}
+		return string(data[:len(data)-1]), nil
+	case 'v':
+		// The value is followed by a nul byte and its type string
+		for i := len(data) - 1; i >= 0; i-- {
+			if data[i] == 0 {
+				return ParseGVariant(string(data[i+1:]), data[:i])
+			}
+		}
+		return nil, fmt.Errorf("gvariant variant has no type")
+	case 'a':
+		return decodeGVariantArray(t, data)
+	case '(', '{':
+		return decodeGVariantTuple(t, data)
+	}
+	return nil, fmt.Errorf("unsupported gvariant type '%c'", t.code)
+}
+
+func decodeGVariantArray(t gvariantType, data []byte) (interface{}, error) {
+	values := []interface{}{}
+	if len(data) == 0 {
+		return values, nil
+	}
+	elem := *t.elem
+	if elem.fixedSize != 0 {
+		if len(data)%elem.fixedSize != 0 {
+			return nil, fmt.Errorf("gvariant array size %d is not a multiple of %d", len(data), elem.fixedSize)
+		}
+		for i := 0; i < len(data); i += elem.fixedSize {
+			value, err := decodeGVariant(elem, data[i:i+elem.fixedSize])
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+
+	// The end offsets of the elements follow them, the last one locates the offsets
+	offsetSize := gvariantOffsetSize(len(data))
+	offsetsStart := readGVariantOffset(data[len(data)-offsetSize:], offsetSize)
+	if offsetsStart > len(data) || (len(data)-offsetsStart)%offsetSize != 0 {
+		return nil, fmt.Errorf("invalid gvariant array framing")
+	}
+	start := 0
+	for pos := offsetsStart; pos < len(data); pos += offsetSize {
+		end := readGVariantOffset(data[pos:], offsetSize)
+		start = alignGVariant(start, elem.alignment)
+		if start > end || end > offsetsStart {
+			return nil, fmt.Errorf("invalid gvariant array element offset")
+		}
+		value, err := decodeGVariant(elem, data[start:end])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		start = end
+	}
+	return values, nil
+}
+
+func decodeGVariantTuple(t gvariantType, data []byte) (interface{}, error) {
+	values := []interface{}{}
+	offsetSize := gvariantOffsetSize(len(data))
+	// The end offsets of the variable-size members, except the last one, are stored backwards at the end
+	framesEnd := len(data)
+	pos := 0
+	for i, member := range t.members {
+		pos = alignGVariant(pos, member.alignment)
+		var end int
+		switch {
+		case member.fixedSize != 0:
+			end = pos + member.fixedSize
+		case i == len(t.members)-1:
+			end = framesEnd
+		default:
+			framesEnd -= offsetSize
+			if framesEnd < 0 {
+				return nil, fmt.Errorf("invalid gvariant tuple framing")
+			}
+			end = readGVariantOffset(data[framesEnd:], offsetSize)
+		}
+		if pos > end || end > framesEnd {
+			return nil, fmt.Errorf("invalid gvariant tuple member offset")
+		}
+		value, err := decodeGVariant(member, data[pos:end])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		pos = end
+	}
+	return values, nil
+}
@@ -0,0 +1,94 @@
+package utility
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// The data was serialized by GLib, g_variant_get_data of the normal form of the text value
+func TestParseGVariant(t *testing.T) {
+	tests := []struct {
+		value      string // GVariant text format
+		typeString string
+		data       string
+		want       interface{}
+	}{
+		{"@y 7", "y", "07", byte(7)},
+		{"true", "b", "01", true},
+		{"@n -2", "n", "feff", int16(-2)},
+		{"@q 65535", "q", "ffff", uint16(65535)},
+		{"@i -5", "i", "fbffffff", int32(-5)},
+		{"@u 4000000000", "u", "00286bee", uint32(4000000000)},
+		{"@x -9000000000", "x", "00e68ee7fdffffff", int64(-9000000000)},
+		{"@t 18000000000000000000", "t", "000008c5a1d8ccf9", uint64(18000000000000000000)},
+		{"@d 1.5", "d", "000000000000f83f", 1.5},
+		{"'hello'", "s", "68656c6c6f00", "hello"},
+		{"@o '/org/flatpak'", "o", "2f6f72672f666c617470616b00", "/org/flatpak"},
+		{"@g 'a{sv}'", "g", "617b73767d00", "a{sv}"},
+		{"@as ['a', 'bc', '']", "as", "610062630000020506", []interface{}{"a", "bc", ""}},
+		{"@ay [1, 2, 3]", "ay", "010203", []interface{}{byte(1), byte(2), byte(3)}},
+		{"@ai [1, 2]", "ai", "0100000002000000", []interface{}{int32(1), int32(2)}},
+		{"(@i 1, 'x', @y 2)", "(isy)", "0100000078000206", []interface{}{int32(1), "x", byte(2)}},
+		{"@(s) ('only',)", "(s)", "6f6e6c7900", []interface{}{"only"}},
+		{"<<@b true>>", "v", "0100620076", true},
+		{
+			"@a{sv} {'a': <'x'>, 'b': <@u 7>}", "a{sv}",
+			"610000000000000078000073020000006200000000000000070000000075020d1f",
+			[]interface{}{[]interface{}{"a", "x"}, []interface{}{"b", uint32(7)}},
+		},
+		{
+			"@a(si) [('one', 1), ('two', 2)]", "a(si)",
+			"6f6e6500010000000400000074776f0002000000040915",
+			[]interface{}{[]interface{}{"one", int32(1)}, []interface{}{"two", int32(2)}},
+		},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseGVariant(test.typeString, data)
+		if err != nil {
+			t.Errorf("%s: %v", test.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.value, got, test.want)
+		}
+	}
+
+	// The empty array has no data
+	got, err := ParseGVariant("as", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, ok := got.([]interface{}); !ok || len(items) != 0 {
+		t.Errorf("@as []: got %#v", got)
+	}
+}
+
+func TestParseGVariantErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		typeString string
+		data       string
+	}{
+		{"truncated integer", "u", "0028"},
+		{"string without nul", "s", "68656c6c6f"},
+		{"offset out of range", "as", "6100ff"},
+		{"truncated tuple", "(ssasta{sv})", "666c617468756200"},
+		{"unclosed tuple", "(ss", "6100620001"},
+		{"unknown type", "z", "00"},
+		{"trailing type", "ss", "610000"},
+	}
+	for _, test := range tests {
+		data, err := hex.DecodeString(test.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := ParseGVariant(test.typeString, data); err == nil {
+			t.Errorf("%s: no error, got %#v", test.name, got)
+		}
+	}
+}
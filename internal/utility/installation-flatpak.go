@@ -0,0 +1,196 @@
+package utility
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
+)
+
+// Installation types of the default installations
+const (
+	UserInstallationType   = "user"
+	SystemInstallationType = "system"
+)
+
+// Default locations, FLATPAK_USER_DIR, FLATPAK_SYSTEM_DIR and FLATPAK_CONFIG_DIR override them like they do for flatpak
+const (
+	defaultSystemDir = "/var/lib/flatpak"
+	defaultConfigDir = "/etc/flatpak"
+)
+
+// rootDir is the alternate tree the installations are read from, empty for the running system
+var rootDir string
+
+// SetRoot reads the installations from an alternate tree, such as a mounted image or a chroot.
+// All the paths, including the ones of the environment variables, are resolved inside the root.
+func SetRoot(root string) {
+	rootDir = root
+}
+
+// Root returns the alternate tree set with SetRoot, empty for the running system
+func Root() string {
+	return rootDir
+}
+
+// rootPath resolves a path inside the root
+func rootPath(path string) string {
+	if rootDir == "" {
+		return path
+	}
+	return filepath.Join(rootDir, path)
+}
+
+// UserDataDir returns the data directory of the user, $XDG_DATA_HOME or ~/.local/share.
+// It fails when neither $XDG_DATA_HOME nor the home directory is set.
+func UserDataDir() (string, error) {
+	if dataHome := os.Getenv("XDG_DATA_HOME"); dataHome != "" {
+		return dataHome, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "share"), nil
+}
+
+// userDataDir returns the data directory of the user, empty when it is unknown
+func userDataDir() string {
+	dir, err := UserDataDir()
+	if err != nil {
+		// Without a home directory the user installation does not exist
+		return ""
+	}
+	return dir
+}
+
+// Installation describes a flatpak installation
+type Installation struct {
+	ID          string // user, system or the id of a custom installation
+	Path        string
+	DisplayName string
+	StorageType string
+	Priority    int
+}
+
+// UserInstallation returns the per-user installation
+func UserInstallation() Installation {
+	path := os.Getenv("FLATPAK_USER_DIR")
+	if path == "" {
+		path = filepath.Join(userDataDir(), "flatpak")
+	}
+	return Installation{
+		ID:   UserInstallationType,
+		Path: rootPath(path),
+	}
+}
+
+// SystemInstallation returns the default system-wide installation
+func SystemInstallation() Installation {
+	path := os.Getenv("FLATPAK_SYSTEM_DIR")
+	if path == "" {
+		path = defaultSystemDir
+	}
+	return Installation{
+		ID:   SystemInstallationType,
+		Path: rootPath(path),
+	}
+}
+
+// installationsConfigDir returns the directory of the custom installations configuration
+func installationsConfigDir() string {
+	configDir := os.Getenv("FLATPAK_CONFIG_DIR")
+	if configDir == "" {
+		configDir = defaultConfigDir
+	}
+	return rootPath(filepath.Join(configDir, "installations.d"))
+}
+
+// GetCustomInstallations returns the installations configured in /etc/flatpak/installations.d
+func GetCustomInstallations() ([]Installation, error) {
+	files, err := filepath.Glob(installationsConfigDir() + "/*.conf")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var installations []Installation
+	for _, file := range files {
+		fileInstallations, err := parseInstallationsFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		installations = append(installations, fileInstallations...)
+	}
+	return installations, nil
+}
+
+// parseInstallationsFile parses the [Installation "id"] groups of an installations.d file
+func parseInstallationsFile(filePath string) ([]Installation, error) {
+	k, err := keyfile.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var installations []Installation
+	for _, group := range k.Groups() {
+		if !strings.HasPrefix(group, "Installation \"") || !strings.HasSuffix(group, "\"") {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(group, "Installation \""), "\"")
+		// The "default" id configures the default system installation
+		if id == "default" {
+			continue
+		}
+		installation := Installation{ID: id}
+		if path, ok := k.String(group, "Path"); ok {
+			installation.Path = rootPath(path)
+		}
+		installation.DisplayName, _ = k.String(group, "DisplayName")
+		installation.StorageType, _ = k.String(group, "StorageType")
+		if priority, ok := k.String(group, "Priority"); ok {
+			installation.Priority, _ = strconv.Atoi(priority)
+		}
+		installations = append(installations, installation)
+	}
+
+	for _, installation := range installations {
+		if installation.Path == "" {
+			return nil, fmt.Errorf("installation '%s' has no Path", installation.ID)
+		}
+	}
+	return installations, nil
+}
+
+// GetInstallations returns the user, system and custom installations
+func GetInstallations() ([]Installation, error) {
+	installations := []Installation{UserInstallation(), SystemInstallation()}
+	custom, err := GetCustomInstallations()
+	if err != nil {
+		return installations, err
+	}
+	return append(installations, custom...), nil
+}
+
+// InstallationFlag returns the flatpak option selecting an installation
+func InstallationFlag(installationType string) string {
+	switch installationType {
+	case UserInstallationType, SystemInstallationType:
+		return "--" + installationType
+	default:
+		return "--installation=" + installationType
+	}
+}
+
+// ParseInstallationName converts the installation column of flatpak list to an installation type.
+// Custom installations are shown as "system (id)".
+func ParseInstallationName(name string) string {
+	name = strings.TrimSpace(name)
+	if strings.HasPrefix(name, SystemInstallationType+" (") && strings.HasSuffix(name, ")") {
+		return strings.TrimSuffix(strings.TrimPrefix(name, SystemInstallationType+" ("), ")")
+	}
+	return name
+}
@@ -0,0 +1,182 @@
+package utility
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// OverrideFlag is a parsed override flag such as --socket=x11
+type OverrideFlag struct {
+	Option string // Option name without dashes, e.g. socket or nosocket
+	Value  string
+}
+
+// flagKind describes the permission an option acts on and whether it grants or revokes it
+type flagKind struct {
+	Kind  string
+	Grant bool
+}
+
+// overrideOptions maps the flatpak override options to the permission they act on
+var overrideOptions = map[string]flagKind{
+	"share":               {"shared", true},
+	"unshare":             {"shared", false},
+	"socket":              {"sockets", true},
+	"nosocket":            {"sockets", false},
+	"device":              {"devices", true},
+	"nodevice":            {"devices", false},
+	"allow":               {"features", true},
+	"disallow":            {"features", false},
+	"filesystem":          {"filesystems", true},
+	"nofilesystem":        {"filesystems", false},
+	"persist":             {"persistent", true},
+	"env":                 {"environment", true},
+	"unset-env":           {"environment", false},
+	"talk-name":           {"session-bus", true},
+	"own-name":            {"session-bus", true},
+	"no-talk-name":        {"session-bus", false},
+	"system-talk-name":    {"system-bus", true},
+	"system-own-name":     {"system-bus", true},
+	"system-no-talk-name": {"system-bus", false},
+}
+
+// xdgUserDirs maps the default XDG user directories to their flatpak filesystem names
+var xdgUserDirs = map[string]string{
+	"Desktop":   "xdg-desktop",
+	"Documents": "xdg-documents",
+	"Downloads": "xdg-download",
+	"Music":     "xdg-music",
+	"Pictures":  "xdg-pictures",
+	"Public":    "xdg-public-share",
+	"Templates": "xdg-templates",
+	"Videos":    "xdg-videos",
+}
+
+// ParseOverrideFlag parses a flag in the form --option=value
+func ParseOverrideFlag(flag string) (OverrideFlag, bool) {
+	parts := strings.SplitN(strings.TrimSpace(flag), "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "--") {
+		return OverrideFlag{}, false
+	}
+	option := strings.TrimPrefix(parts[0], "--")
+	if _, ok := overrideOptions[option]; !ok {
+		return OverrideFlag{}, false
+	}
+	return OverrideFlag{Option: option, Value: parts[1]}, true
+}
+
+func (f OverrideFlag) String() string {
+	return fmt.Sprintf("--%s=%s", f.Option, f.Value)
+}
+
+// Kind returns the permission the flag acts on, e.g. sockets or filesystems
+func (f OverrideFlag) Kind() string {
+	return overrideOptions[f.Option].Kind
+}
+
+// Grants reports whether the flag grants the permission instead of revoking it
+func (f OverrideFlag) Grants() bool {
+	return overrideOptions[f.Option].Grant
+}
+
+// Subject returns what the flag acts on: the path without mode of filesystems,
+// the variable name of environment flags and the value otherwise.
+func (f OverrideFlag) Subject() string {
+	switch f.Kind() {
+	case "filesystems":
+		path, _ := splitFilesystemMode(f.Value)
+		return path
+	case "environment":
+		return strings.SplitN(f.Value, "=", 2)[0]
+	default:
+		return f.Value
+	}
+}
+
+// splitFilesystemMode splits a filesystem value such as home:ro in path and mode
+func splitFilesystemMode(value string) (string, string) {
+	if i := strings.LastIndex(value, ":"); i >= 0 {
+		switch mode := value[i+1:]; mode {
+		case "ro", "rw", "create", "reset":
+			return value[:i], mode
+		}
+	}
+	return value, ""
+}
+
+// normalizeFilesystem returns the canonical form of a filesystem value
+func normalizeFilesystem(value string) string {
+	path, mode := splitFilesystemMode(value)
+	if path != "/" {
+		path = strings.TrimRight(path, "/")
+	}
+	if path == "~" {
+		path = "home"
+	} else if strings.HasPrefix(path, "~/") {
+		dir := strings.SplitN(strings.TrimPrefix(path, "~/"), "/", 2)
+		if xdg, ok := xdgUserDirs[dir[0]]; ok {
+			path = xdg
+			if len(dir) == 2 {
+				path += "/" + dir[1]
+			}
+		}
+	}
+	// Read-write is the default mode
+	if mode == "" || mode == "rw" {
+		return path
+	}
+	return path + ":" + mode
+}
+
+// NormalizeFlag returns the canonical form of an override flag, e.g.
+// --filesystem=~/Downloads becomes --filesystem=xdg-download and --filesystem=home:rw becomes --filesystem=home.
+// Flags that are not recognised are returned unchanged.
+func NormalizeFlag(flag string) string {
+	f, ok := ParseOverrideFlag(flag)
+	if !ok {
+		return flag
+	}
+	switch f.Kind() {
+	case "filesystems":
+		f.Value = normalizeFilesystem(f.Value)
+	case "persistent":
+		f.Value = strings.TrimRight(f.Value, "/")
+	}
+	return f.String()
+}
+
+// NormalizeFlags normalizes a list of override flags and removes duplicates
+func NormalizeFlags(flags []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, flag := range flags {
+		flag = NormalizeFlag(flag)
+		if seen[flag] {
+			continue
+		}
+		seen[flag] = true
+		result = append(result, flag)
+	}
+	return result
+}
+
+// FlagConflicts returns an error for each permission that is set in different ways by the flags,
+// such as --socket=x11 together with --nosocket=x11.
+func FlagConflicts(flags []string) error {
+	var errs []error
+	subjects := make(map[string]string)
+	for _, flag := range NormalizeFlags(flags) {
+		f, ok := ParseOverrideFlag(flag)
+		if !ok {
+			continue
+		}
+		key := f.Kind() + "|" + f.Subject()
+		if previous, exists := subjects[key]; exists {
+			errs = append(errs, fmt.Errorf("conflicting overrides: %s and %s", previous, flag))
+			continue
+		}
+		subjects[key] = flag
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,54 @@
+package utility
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// GlobalOverride is the name of the override file that applies to all applications
+const GlobalOverride = "global"
+
+// OverridesDir returns the directory holding the override files of an installation.
+// flatpak override --system uses the default system installation.
+func OverridesDir(installation Installation) string {
+	return filepath.Join(installation.Path, "overrides")
+}
+
+// ReadOverrides reads the override file of an application, or the global one, as override flags.
+// A missing file means that there are no overrides.
+func ReadOverrides(installation Installation, appID string) ([]string, error) {
+	path := filepath.Join(OverridesDir(installation), appID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	flags, err := ParseFlatpakPermissions(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return flags, nil
+}
+
+// ListOverrides returns the applications having an override file in an installation, the global file excluded
+func ListOverrides(installation Installation) ([]string, error) {
+	entries, err := os.ReadDir(OverridesDir(installation))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var apps []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && entry.Name() != GlobalOverride {
+			apps = append(apps, entry.Name())
+		}
+	}
+	sort.Strings(apps)
+	return apps, nil
+}
@@ -3,61 +3,74 @@ package utility
 import (
 	"fmt"
 	"strings"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
 )
 
 // MapPermissionsToFlatpakOverrideFlags maps permissions to Flatpak override flags
-func MapPermissionsToFlatpakOverrideFlags(permissionContext string) []string {
+func MapPermissionsToFlatpakOverrideFlags(permissionContext string) ([]string, error) {
 	return ParseFlatpakPermissions(permissionContext)
 }
 
-// ParseFlatpakPermissions parses the given permissions and returns Flatpak override flags
-func ParseFlatpakPermissions(permissionContext string) []string {
-	lines := strings.Split(permissionContext, "\n")
+// ParseFlatpakPermissions parses the given permissions and returns normalized Flatpak override flags.
+// A malformed key file is an error, it must not be mistaken for a file without permissions.
+func ParseFlatpakPermissions(permissionContext string) ([]string, error) {
 	flags := []string{}
-	parsingSection := ""
-
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-
-		if line == "" || strings.HasPrefix(line, "[") {
-			parsingSection = line
-			continue
-		}
+	k, err := keyfile.Parse([]byte(permissionContext))
+	if err != nil {
+		return nil, err
+	}
 
-		switch parsingSection {
-		case "[Context]":
+	for _, group := range k.Groups() {
+		switch group {
+		case "Context":
 			// Logic for processing [Context] section key-value pairs
-			parts := strings.SplitN(line, "=", 2)
-			if len(parts) != 2 {
-				continue
+			for _, key := range k.Keys(group) {
+				values, _ := k.StringList(group, key)
+				for _, value := range values {
+					flag := ""
+					if value == "" {
+						continue
+					}
+					if strings.HasPrefix(value, "!") {
+						flag = getNegativeContextFlag(key, strings.TrimPrefix(value, "!"))
+					} else {
+						flag = getContextFlag(key, value)
+					}
+					// Keys without an override option are skipped
+					if flag != "" {
+						flags = append(flags, flag)
+					}
+				}
 			}
 
-			key := parts[0]
-			values := strings.Split(parts[1], ";")
-			for _, value := range values {
-				flag := ""
-				if value == "" {
-					continue
+		case "Environment":
+			// Variables set with --env, the ones unset with --unset-env are listed in unset-environment
+			unset := make(map[string]bool)
+			if names, ok := k.StringList("Context", "unset-environment"); ok {
+				for _, name := range names {
+					unset[name] = true
 				}
-				if strings.HasPrefix(value, "!") {
-					flag = getNegativeContextFlag(key, strings.TrimPrefix(value, "!"))
-				} else {
-					flag = getContextFlag(key, value)
+			}
+			for _, name := range k.Keys(group) {
+				if unset[name] {
+					continue
 				}
-				flags = append(flags, flag)
+				value, _ := k.String(group, name)
+				flags = append(flags, fmt.Sprintf("--env=%s=%s", name, value))
 			}
 
-		case "[Session Bus Policy]", "[System Bus Policy]":
+		case "Session Bus Policy", "System Bus Policy":
 			// Logic for processing [Session Bus Policy] and [System Bus Policy] sections
-			parts := strings.Split(line, "=")
-			if len(parts) == 2 {
-				flag := fmt.Sprintf("--%s-name=%s", getContextPolicyFlag(parts[1]), parts[0])
-				flags = append(flags, flag)
+			for _, name := range k.Keys(group) {
+				policy, _ := k.String(group, name)
+				if flag, ok := getBusPolicyFlag(group == "System Bus Policy", policy, name); ok {
+					flags = append(flags, flag)
+				}
 			}
 		}
 	}
 
-	return flags
+	return NormalizeFlags(flags), nil
 }
 
 // Helper function to get context flags for [Context] section
@@ -75,6 +88,8 @@ func getContextFlag(key, value string) string {
 		return fmt.Sprintf("--filesystem=%s", value)
 	case "persistent":
 		return fmt.Sprintf("--persist=%s", value)
+	case "unset-environment":
+		return fmt.Sprintf("--unset-env=%s", value)
 	default:
 		return ""
 	}
@@ -92,63 +107,99 @@ func getNegativeContextFlag(key, value string) string {
 	case "features":
 		return fmt.Sprintf("--disallow=%s", value)
 	case "filesystems":
+		// The mode is kept, !host:reset is --nofilesystem=host:reset
 		return fmt.Sprintf("--nofilesystem=%s", value)
 	default:
+		// persistent and unset-environment cannot be negated
 		return ""
 	}
 }
 
-// Helper function to get context policy flag for [Session Bus Policy] and [System Bus Policy] sections
-func getContextPolicyFlag(value string) string {
-	switch value {
+// Helper function to get the flag of a bus name policy in the [Session Bus Policy] and [System Bus Policy] sections.
+// The "see" policy and unknown policies have no override option and are skipped.
+func getBusPolicyFlag(systemBus bool, policy, name string) (string, bool) {
+	var option string
+	switch policy {
 	case "own":
-		return "own"
+		option = "own-name"
 	case "talk":
-		return "talk"
+		option = "talk-name"
+	case "none":
+		option = "no-talk-name"
 	default:
-		return "no-talk"
+		return "", false
+	}
+	if systemBus {
+		option = "system-" + option
 	}
+	return fmt.Sprintf("--%s=%s", option, name), true
 }
 
-// Helper function to negate a flag in the form --flag=value or --negate-flag=value
-func NegateFlag(fullFlag string) string {
-	parts := strings.SplitN(fullFlag, "=", 2)
-	if len(parts) != 2 {
-		return ""
-	}
-	flag := strings.TrimPrefix(parts[0], "--")
-	value := parts[1]
+// contextKeys maps the override options to their [Context] key, the options starting with no or un revoke the value
+var contextKeys = map[string]string{
+	"share":        "shared",
+	"unshare":      "shared",
+	"socket":       "sockets",
+	"nosocket":     "sockets",
+	"device":       "devices",
+	"nodevice":     "devices",
+	"allow":        "features",
+	"disallow":     "features",
+	"filesystem":   "filesystems",
+	"nofilesystem": "filesystems",
+	"persist":      "persistent",
+	"unset-env":    "unset-environment",
+}
 
-	switch flag {
-		case "share":
-			return fmt.Sprintf("--unshare=%s", value)
-		case "unshare":
-			return fmt.Sprintf("--share=%s", value)
-		case "socket":
-			return fmt.Sprintf("--nosocket=%s", value)
-		case "nosocket":
-			return fmt.Sprintf("--socket=%s", value)
-		case "device":
-			return fmt.Sprintf("--nodevice=%s", value)
-		case "nodevice":
-			return fmt.Sprintf("--device=%s", value)
-		case "allow":
-			return fmt.Sprintf("--disallow=%s", value)
-		case "disallow":
-			return fmt.Sprintf("--allow=%s", value)
-		case "filesystem":
-			return fmt.Sprintf("--nofilesystem=%s", value)
-		case "nofilesystem":
-			return fmt.Sprintf("--filesystem=%s", value)
-		case "persist":
-			// Assuming there's no specific negative form for persist
-			return ""
-		case "talk-name":
-			return fmt.Sprintf("--no-talk-name=%s", value)
-		case "no-talk-name":
-			return fmt.Sprintf("--talk-name=%s", value)
-		default:
-			return ""
-	}
+// busPolicies maps the bus name options to their group and policy
+var busPolicies = map[string][2]string{
+	"talk-name":           {"Session Bus Policy", "talk"},
+	"own-name":            {"Session Bus Policy", "own"},
+	"no-talk-name":        {"Session Bus Policy", "none"},
+	"system-talk-name":    {"System Bus Policy", "talk"},
+	"system-own-name":     {"System Bus Policy", "own"},
+	"system-no-talk-name": {"System Bus Policy", "none"},
 }
 
+// OverrideFlagsToKeyFile converts override flags to the groups of an override file,
+// ParseFlatpakPermissions performs the reverse conversion. Flags that are not recognised are skipped.
+func OverrideFlagsToKeyFile(flags []string) *keyfile.KeyFile {
+	k := keyfile.New()
+	contextValues := make(map[string][]string)
+	var contextOrder []string
+	var others [][3]string // Group, key and value of the other groups, written after [Context]
+	for _, flag := range NormalizeFlags(flags) {
+		f, ok := ParseOverrideFlag(flag)
+		if !ok {
+			continue
+		}
+		if key, ok := contextKeys[f.Option]; ok {
+			value := f.Value
+			if !f.Grants() && f.Option != "unset-env" {
+				value = "!" + value
+			}
+			if _, seen := contextValues[key]; !seen {
+				contextOrder = append(contextOrder, key)
+			}
+			contextValues[key] = append(contextValues[key], value)
+			continue
+		}
+		if policy, ok := busPolicies[f.Option]; ok {
+			others = append(others, [3]string{policy[0], f.Value, policy[1]})
+			continue
+		}
+		if f.Option == "env" {
+			parts := strings.SplitN(f.Value, "=", 2)
+			if len(parts) == 2 {
+				others = append(others, [3]string{"Environment", parts[0], parts[1]})
+			}
+		}
+	}
+	for _, key := range contextOrder {
+		k.SetStringList("Context", key, contextValues[key])
+	}
+	for _, setting := range others {
+		k.Set(setting[0], setting[1], setting[2])
+	}
+	return k
+}
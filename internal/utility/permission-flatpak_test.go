@@ -0,0 +1,152 @@
+package utility
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// firefoxMetadata is the metadata of org.mozilla.firefox as shown by flatpak info -M
+const firefoxMetadata = `[Application]
+name=org.mozilla.firefox
+runtime=org.freedesktop.Platform/x86_64/23.08
+sdk=org.freedesktop.Sdk/x86_64/23.08
+command=firefox
+
+[Context]
+shared=network;ipc;
+sockets=x11;wayland;pcsc;cups;pulseaudio;
+devices=all;
+filesystems=xdg-download;/run/.heim_org.h5l.kcm-socket;
+persistent=.mozilla;
+
+[Session Bus Policy]
+org.freedesktop.FileManager1=talk
+org.a11y.Bus=talk
+org.mpris.MediaPlayer2.firefox.*=own
+
+[System Bus Policy]
+org.freedesktop.NetworkManager=talk
+`
+
+// overrideFile is an override file written by flatpak override, with every group it can contain
+const overrideFile = `[Context]
+sockets=!x11;wayland;
+filesystems=!home;xdg-documents:ro;
+unset-environment=GTK_THEME;
+
+[Session Bus Policy]
+org.freedesktop.Flatpak=none
+org.kde.StatusNotifierWatcher=see
+org.example.Service=own
+
+[System Bus Policy]
+org.freedesktop.login1=talk
+org.freedesktop.UPower=none
+org.freedesktop.Avahi=see
+
+[Environment]
+MOZ_ENABLE_WAYLAND=1
+GTK_THEME=Adwaita
+`
+
+func TestGetBusPolicyFlag(t *testing.T) {
+	tests := []struct {
+		systemBus bool
+		policy    string
+		want      string
+	}{
+		{false, "talk", "--talk-name=org.example.Bus"},
+		{false, "own", "--own-name=org.example.Bus"},
+		{false, "none", "--no-talk-name=org.example.Bus"},
+		{false, "see", ""},
+		{false, "unknown", ""},
+		{true, "talk", "--system-talk-name=org.example.Bus"},
+		{true, "own", "--system-own-name=org.example.Bus"},
+		{true, "none", "--system-no-talk-name=org.example.Bus"},
+		{true, "see", ""},
+	}
+	for _, test := range tests {
+		flag, ok := getBusPolicyFlag(test.systemBus, test.policy, "org.example.Bus")
+		if flag != test.want || ok != (test.want != "") {
+			t.Errorf("system bus %v, policy %s: got %q %v, want %q", test.systemBus, test.policy, flag, ok, test.want)
+		}
+	}
+}
+
+func TestParseFlatpakPermissions(t *testing.T) {
+	tests := map[string]struct {
+		data string
+		want []string
+	}{
+		"metadata": {firefoxMetadata, []string{
+			"--device=all",
+			"--filesystem=/run/.heim_org.h5l.kcm-socket",
+			"--filesystem=xdg-download",
+			"--own-name=org.mpris.MediaPlayer2.firefox.*",
+			"--persist=.mozilla",
+			"--share=ipc",
+			"--share=network",
+			"--socket=cups",
+			"--socket=pcsc",
+			"--socket=pulseaudio",
+			"--socket=wayland",
+			"--socket=x11",
+			"--system-talk-name=org.freedesktop.NetworkManager",
+			"--talk-name=org.a11y.Bus",
+			"--talk-name=org.freedesktop.FileManager1",
+		}},
+		"override": {overrideFile, []string{
+			"--env=MOZ_ENABLE_WAYLAND=1",
+			"--filesystem=xdg-documents:ro",
+			"--no-talk-name=org.freedesktop.Flatpak",
+			"--nofilesystem=home",
+			"--nosocket=x11",
+			"--own-name=org.example.Service",
+			"--socket=wayland",
+			"--system-no-talk-name=org.freedesktop.UPower",
+			"--system-talk-name=org.freedesktop.login1",
+			"--unset-env=GTK_THEME",
+		}},
+	}
+	for name, test := range tests {
+		flags, err := ParseFlatpakPermissions(test.data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		sorted := append([]string{}, flags...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, test.want) {
+			t.Errorf("%s: got %q, want %q", name, sorted, test.want)
+		}
+	}
+}
+
+func TestOverrideFlagsRoundTrip(t *testing.T) {
+	for name, data := range map[string]string{"metadata": firefoxMetadata, "override": overrideFile} {
+		flags, err := ParseFlatpakPermissions(data)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		written := OverrideFlagsToKeyFile(flags).Bytes()
+		parsed, err := ParseFlatpakPermissions(string(written))
+		if err != nil {
+			t.Fatalf("%s: %v\n%s", name, err, written)
+		}
+		if !reflect.DeepEqual(parsed, flags) {
+			t.Errorf("%s: written as\n%s\nparsed back as %q, want %q", name, written, parsed, flags)
+		}
+	}
+}
+
+func TestParseFlatpakPermissionsMalformed(t *testing.T) {
+	// A malformed override file is not a file without overrides
+	for _, data := range []string{"shared=network;\n", "[Context]\nshared\n"} {
+		if flags, err := ParseFlatpakPermissions(data); err == nil {
+			t.Errorf("%q: no error, flags %q", data, flags)
+		}
+	}
+	if flags, err := ParseFlatpakPermissions(""); err != nil || len(flags) != 0 {
+		t.Errorf("empty file: flags %q, error %v", flags, err)
+	}
+}
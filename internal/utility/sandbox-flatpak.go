@@ -0,0 +1,92 @@
+package utility
+
+// Permission layers, in the order flatpak applies them
+const (
+	LayerMetadata     = "metadata"
+	LayerGlobalSystem = "global-system"
+	LayerSystem       = "system"
+	LayerGlobalUser   = "global-user"
+	LayerUser         = "user"
+)
+
+// filesystemReset is the subject of --nofilesystem=host:reset, which revokes the filesystems of the previous layers
+const filesystemReset = "host"
+
+// PermissionLayer is a list of override flags applied at one level of the sandbox
+type PermissionLayer struct {
+	Name  string
+	Flags []string
+}
+
+// EffectivePermission is a permission of the computed sandbox and the layer that set it last
+type EffectivePermission struct {
+	Kind    string // sockets, filesystems, session-bus, ...
+	Subject string // Socket name, path, bus name, ...
+	Flag    string // Flag that set the permission
+	Granted bool
+	Layer   string
+}
+
+// EffectivePermissions applies the layers in order and returns the resulting sandbox permissions.
+// A flag acting on the same permission as a previous layer replaces it. Like flatpak, a layer with
+// --nofilesystem=host:reset first drops the filesystems of the previous layers, its own are kept.
+func EffectivePermissions(layers ...PermissionLayer) []EffectivePermission {
+	var permissions []EffectivePermission
+	index := make(map[string]int)
+
+	for _, layer := range layers {
+		flags := NormalizeFlags(layer.Flags)
+		if hasFilesystemReset(flags) {
+			permissions, index = dropFilesystems(permissions)
+		}
+		for _, flag := range flags {
+			f, ok := ParseOverrideFlag(flag)
+			if !ok {
+				continue
+			}
+			permission := EffectivePermission{
+				Kind:    f.Kind(),
+				Subject: f.Subject(),
+				Flag:    flag,
+				Granted: f.Grants(),
+				Layer:   layer.Name,
+			}
+			key := permission.Kind + "|" + permission.Subject
+			if i, exists := index[key]; exists {
+				permissions[i] = permission
+			} else {
+				index[key] = len(permissions)
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return permissions
+}
+
+// hasFilesystemReset reports whether the flags contain --nofilesystem=host:reset
+func hasFilesystemReset(flags []string) bool {
+	for _, flag := range flags {
+		f, ok := ParseOverrideFlag(flag)
+		if !ok || f.Option != "nofilesystem" {
+			continue
+		}
+		if path, mode := splitFilesystemMode(f.Value); path == filesystemReset && mode == "reset" {
+			return true
+		}
+	}
+	return false
+}
+
+// dropFilesystems removes the filesystem permissions and rebuilds the index of the remaining ones
+func dropFilesystems(permissions []EffectivePermission) ([]EffectivePermission, map[string]int) {
+	var kept []EffectivePermission
+	index := make(map[string]int)
+	for _, permission := range permissions {
+		if permission.Kind == "filesystems" {
+			continue
+		}
+		index[permission.Kind+"|"+permission.Subject] = len(kept)
+		kept = append(kept, permission)
+	}
+	return kept, index
+}
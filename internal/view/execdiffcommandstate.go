@@ -3,50 +3,79 @@ package view
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
 	"github.com/faan11/flatpak-compose/internal/state"
 )
 
-func printOutput(reader io.Reader) {
-	scanner := bufio.NewScanner(reader)
-	for scanner.Scan() {
-		fmt.Println(scanner.Text())
+// runOperation writes the files of the operation in dir and runs its command
+func runOperation(op model.Operation, dir string) error {
+	if err := writeOperationFiles([]model.Operation{op}, dir); err != nil {
+		return err
 	}
+	args := op.ResolveArgs(operationFilePath(dir))
+	for _, line := range renderOperation(op, dir) {
+		if strings.HasPrefix(line, "#") {
+			fmt.Println(line)
+		} else {
+			fmt.Printf("+ %s \n", line)
+		}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
 
-func executeShellCommandsAndGetOutput(commands []string) {
-	for _, cmdStr := range commands {
-		fmt.Printf("+ %s \n", cmdStr)
-		cmd := exec.Command("sh", "-c", cmdStr)
-
-		// Create pipes to capture stdout and stderr
-		stdout, err := cmd.StdoutPipe()
-		if err != nil {
-			fmt.Printf("Error creating stdout pipe: %s\n", err)
+// executeOperations runs the operations in order and returns the number of failed operations.
+// The files of the operations are written in dir. The dependents of a failed operation are skipped.
+// With rollback, the first failure stops the execution and the completed operations are reverted
+// in reverse order when they are reversible.
+func executeOperations(operations []model.Operation, dir string, rollback bool) int {
+	failed := 0
+	unavailable := make(map[string]bool) // Failed or skipped operations
+	var completed []model.Operation
+	for _, op := range operations {
+		skip := false
+		for _, dep := range op.DependsOn {
+			if unavailable[dep] {
+				skip = true
+			}
+		}
+		if skip {
+			fmt.Printf("Skipped %s: a dependency failed\n", op.ID)
+			unavailable[op.ID] = true
+			failed++
 			continue
 		}
-		stderr, err := cmd.StderrPipe()
-		if err != nil {
-			fmt.Printf("Error creating stderr pipe: %s\n", err)
+		if err := runOperation(op, dir); err != nil {
+			fmt.Printf("Error executing command: %s\n", err)
+			unavailable[op.ID] = true
+			failed++
+			if rollback {
+				rollbackOperations(completed, dir)
+				return failed
+			}
 			continue
 		}
+		completed = append(completed, op)
+	}
+	return failed
+}
 
-		// Start the command
-		if err := cmd.Start(); err != nil {
-			fmt.Printf("Error starting command: %s\n", err)
+// rollbackOperations reverts the completed operations in reverse order
+func rollbackOperations(completed []model.Operation, dir string) {
+	fmt.Println("Rollback:")
+	for i := len(completed) - 1; i >= 0; i-- {
+		op := completed[i]
+		if !op.Reversible() {
+			fmt.Printf("Cannot revert %s\n", op.ID)
 			continue
 		}
-
-		// Read stdout and stderr streams concurrently
-		go printOutput(stdout)
-		go printOutput(stderr)
-
-		// Wait for the command to finish
-		if err := cmd.Wait(); err != nil {
-			fmt.Printf("Error executing command: %s", err)
+		if err := runOperation(*op.Revert, dir); err != nil {
+			fmt.Printf("Error reverting %s: %s\n", op.ID, err)
 		}
 	}
 }
@@ -68,28 +97,45 @@ func askForConfirmation(prompt string) bool {
 	}
 }
 
-func ExecDiffCommands(diff state.DiffState, assumeyes bool) {
-	list := GenDiffStateCommands(diff)
-	if len(list) != 0 {
+// ExecDiffCommands executes the operations of the diff in dependency order and reports whether all of them succeeded.
+// With rollback, a failure reverts the completed operations.
+func ExecDiffCommands(diff state.DiffState, assumeyes, rollback bool) bool {
+	operations, err := BuildOperationGraph(GenDiffStateOperations(diff))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	if len(operations) != 0 {
+		dir, err := os.MkdirTemp("", "flatpak-compose-")
+		if err != nil {
+			fmt.Printf("Error creating temporary directory: %s\n", err)
+			return false
+		}
+		defer os.RemoveAll(dir)
+
 		fmt.Printf("Commands: \n")
-		printShellCommands(list)
+		printOperations(operations, dir)
 		if !assumeyes {
 			confirmed := askForConfirmation("Are you sure you want to continue?")
 			if confirmed {
 				fmt.Printf("Execution: \n")
-				executeShellCommandsAndGetOutput(list)
+				failed := executeOperations(operations, dir, rollback)
 				fmt.Println("Completed")
 				// Perform the actions you want after confirmation
+				return failed == 0
 			} else {
 				fmt.Println("Cancelled.")
 				// Handle cancellation or exit
+				return false
 			}
 		} else {
 			fmt.Printf("Execution: \n")
-			executeShellCommandsAndGetOutput(list)
+			failed := executeOperations(operations, dir, rollback)
 			fmt.Println("Completed")
+			return failed == 0
 		}
 	} else {
 		fmt.Println("No changes needs to be done")
+		return true
 	}
 }
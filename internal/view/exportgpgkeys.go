@@ -0,0 +1,37 @@
+package view
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"github.com/faan11/flatpak-compose/internal/model"
+)
+
+// WriteGPGKeyFiles writes the GPG keys of the remotes as sidecar files in dir
+// and replaces the inline base64 keys with gpg-key-file references.
+// The references keep dir as given, so it should be relative to the compose file location.
+func WriteGPGKeyFiles(state *model.State, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, env := range state.Environment {
+		for name, remote := range env.Remotes {
+			gpgKey, ok := remote[model.RemoteGPGKey]
+			if !ok || gpgKey == "" {
+				continue
+			}
+			keyData, err := base64.StdEncoding.DecodeString(gpgKey)
+			if err != nil {
+				return fmt.Errorf("remote '%s': invalid GPG key: %w", name, err)
+			}
+			keyFile := filepath.Join(dir, fmt.Sprintf("%s-%s.gpg", name, env.InstallationType))
+			if err := os.WriteFile(keyFile, keyData, 0644); err != nil {
+				return err
+			}
+			delete(remote, model.RemoteGPGKey)
+			remote[model.RemoteGPGKeyFile] = keyFile
+		}
+	}
+	return nil
+}
@@ -1,312 +1,530 @@
 package view
 
 import (
-	"fmt"
-	"io/ioutil"
 	"encoding/base64"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/keyfile"
 	"github.com/faan11/flatpak-compose/internal/model"
 	"github.com/faan11/flatpak-compose/internal/state"
 	"github.com/faan11/flatpak-compose/internal/utility"
 )
 
 
-// ConvertMapToText converts a map to a multiline text string
-func ConvertMapToOptions(m map[string]string) string {
-	var result string
+// ConvertMapToOptions converts a remote map to remote-modify options.
+// The GPG key is imported from a file returned with the options, named after keyFile.
+func ConvertMapToOptions(m map[string]string, keyFile string) ([]string, []model.OperationFile) {
+	var options []string
+	var files []model.OperationFile
 
 	if title, ok := m["xa.title"]; ok {
-		result += fmt.Sprintf("--title=%s\n", title)
+		options = append(options, fmt.Sprintf("--title=%s", title))
 	}
 
 	if url, ok := m["url"]; ok {
-		result += fmt.Sprintf("--url=%s\n", url)
+		options = append(options, fmt.Sprintf("--url=%s", url))
 	}
 
 	if homepage, ok := m["xa.homepage"]; ok {
-		result += fmt.Sprintf("--homepage=%s\n", homepage)
+		options = append(options, fmt.Sprintf("--homepage=%s", homepage))
 	}
 
 	if comment, ok := m["xa.comment"]; ok {
-		result += fmt.Sprintf("--comment=%s\n", comment)
+		options = append(options, fmt.Sprintf("--comment=%s", comment))
 	}
 
 	if description, ok := m["xa.description"]; ok {
-		result += fmt.Sprintf("--description=%s\n", description)
+		options = append(options, fmt.Sprintf("--description=%s", description))
 	}
 
 	if icon, ok := m["xa.icon"]; ok {
-		result += fmt.Sprintf("--icon=%s\n", icon)
+		options = append(options, fmt.Sprintf("--icon=%s", icon))
 	}
 
 	if gpgKey, ok := m["GPGKey"]; ok {
-		file, errs := ioutil.TempFile("", "*.gpg")
-		if errs != nil {
-		   fmt.Println(errs)
-		   return result 
-		}
 		// Decode the base64 string
 		decodedBytes, err := base64.StdEncoding.DecodeString(gpgKey)
 		if err != nil {
-			fmt.Println("Error decoding base64 string:", err)
-			return result
+			fmt.Fprintln(os.Stderr, "Error decoding base64 string:", err)
+			return options, files
 		}
-		// Write the binary data to the file
-		_, err = file.Write(decodedBytes)
-		if err != nil {
-			fmt.Println("Error writing to file:", err)
-			return result
-		}
-		// Close the file
-		errs = file.Close()
-		if errs != nil {
-		   fmt.Println(errs)
-		   return result
-		}
-		result += fmt.Sprintf("--gpg-import=%s\n", file.Name())
+		files = append(files, model.OperationFile{Name: keyFile, Data: decodedBytes})
+		options = append(options, fmt.Sprintf("--gpg-import=%s", model.FilePlaceholder(keyFile)))
 	}
 
-	return result
+	return options, files
 }
 
-// ConvertMapToText converts a map to a multiline text string
+// flatpakRepoKeys lists the [Flatpak Repo] keys written for the remote options, in file order
+var flatpakRepoKeys = []struct{ key, option string }{
+	{"Title", "xa.title"},
+	{"Url", "url"},
+	{"Homepage", "xa.homepage"},
+	{"Comment", "xa.comment"},
+	{"Description", "xa.description"},
+	{"Icon", "xa.icon"},
+	{"GPGKey", "GPGKey"},
+	{"DefaultBranch", "xa.default-branch"},
+	{"CollectionID", "collection-id"},
+}
+
+// ConvertMapToText converts a map to a multiline text string (.flatpakrepo format).
+// utility.ParseFlatpakRepo performs the reverse conversion.
 func ConvertMapToText(m map[string]string) string {
-	var result string
+	k := keyfile.New()
+	for _, repoKey := range flatpakRepoKeys {
+		if value, ok := m[repoKey.option]; ok {
+			k.Set("Flatpak Repo", repoKey.key, value)
+		}
+	}
+	// A file without options still has its group
+	if len(k.Groups()) == 0 {
+		return "[Flatpak Repo]\n"
+	}
+	return string(k.Bytes())
+}
 
-	result += "[Flatpak Repo]\n"
+// operationID builds the identifier of an operation, the graph makes it unique
+func operationID(kind model.OperationKind, installationType, target string) string {
+	return fmt.Sprintf("%s:%s:%s", kind, installationType, target)
+}
 
-	if title, ok := m["xa.title"]; ok {
-		result += fmt.Sprintf("Title=%s\n", title)
+// sortedRemoteNames returns the remote names of an environment in a stable order
+func sortedRemoteNames(remotes map[string]map[string]string) []string {
+	var names []string
+	for name := range remotes {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	return names
+}
 
-	if url, ok := m["url"]; ok {
-		result += fmt.Sprintf("Url=%s\n", url)
+// remoteAddOperation adds a remote from a .flatpakrepo file generated from its options,
+// or from the URL of its .flatpakrepo file when the options are not known
+func remoteAddOperation(installationType, name string, remote map[string]string) model.Operation {
+	var files []model.OperationFile
+	location, ok := remote[model.RemoteFromURL]
+	if !ok {
+		file := model.OperationFile{
+			Name: fmt.Sprintf("%s-%s.flatpakrepo", name, installationType),
+			Data: []byte(ConvertMapToText(remote)),
+		}
+		files = append(files, file)
+		location = "file://" + model.FilePlaceholder(file.Name)
 	}
-
-	if homepage, ok := m["xa.homepage"]; ok {
-		result += fmt.Sprintf("Homepage=%s\n", homepage)
+	args := []string{"flatpak", "remote-add", utility.InstallationFlag(installationType), "--if-not-exists", name, location}
+	// Adds no verification if it is needed.
+	if verify, ok := remote["gpg-verify"]; ok && verify == "false" {
+		args = append(args, "--no-gpg-verify")
+	}
+	return model.Operation{
+		ID:           operationID(model.OperationRemoteAdd, installationType, name),
+		Kind:         model.OperationRemoteAdd,
+		Target:       name,
+		Installation: installationType,
+		Args:         args,
+		Files:        files,
 	}
+}
 
-	if comment, ok := m["xa.comment"]; ok {
-		result += fmt.Sprintf("Comment=%s\n", comment)
+// remoteDeleteOperation deletes a remote
+func remoteDeleteOperation(installationType, name string) model.Operation {
+	return model.Operation{
+		ID:           operationID(model.OperationRemoteDelete, installationType, name),
+		Kind:         model.OperationRemoteDelete,
+		Target:       name,
+		Installation: installationType,
+		Args:         []string{"flatpak", "remote-delete", utility.InstallationFlag(installationType), name},
 	}
+}
 
-	if description, ok := m["xa.description"]; ok {
-		result += fmt.Sprintf("Description=%s\n", description)
+// uninstallOperation uninstalls an application
+func uninstallOperation(app model.FlatpakApplication) model.Operation {
+	return model.Operation{
+		ID:           operationID(model.OperationUninstall, app.InstallationType, app.Name),
+		Kind:         model.OperationUninstall,
+		Target:       app.Name,
+		Remote:       app.Repo,
+		Installation: app.InstallationType,
+		Args:         []string{"flatpak", "uninstall", utility.InstallationFlag(app.InstallationType), "--assumeyes", app.Name},
 	}
+}
 
-	if icon, ok := m["xa.icon"]; ok {
-		result += fmt.Sprintf("Icon=%s\n", icon)
+// overrideScopeFlag returns the flatpak override option of a scope (system or user).
+// The system overrides of an application of a custom installation are the ones of that installation.
+func overrideScopeFlag(app model.FlatpakApplication, scope string) string {
+	if scope == "system" && app.InstallationType != utility.UserInstallationType {
+		return utility.InstallationFlag(app.InstallationType)
 	}
+	return "--" + scope
+}
 
-	if gpgKey, ok := m["GPGKey"]; ok {
-		result += fmt.Sprintf("GPGKey=%s\n", gpgKey)
+// overrideOperation applies overrides of an application in a scope (system or user).
+// It is not reversible: the flags replace values of the override file that the diff does not keep.
+func overrideOperation(app model.FlatpakApplication, scope string, flags []string) model.Operation {
+	return model.Operation{
+		ID:           operationID(model.OperationOverride, app.InstallationType, app.Name+":"+scope),
+		Kind:         model.OperationOverride,
+		Target:       app.Name,
+		Installation: app.InstallationType,
+		Args:         append([]string{"flatpak", "override", overrideScopeFlag(app, scope), app.Name}, flags...),
 	}
+}
 
-	return result
+// overrideResetOperation removes the overrides of an application in a scope (system or user)
+func overrideResetOperation(app model.FlatpakApplication, scope string) model.Operation {
+	return model.Operation{
+		ID:           operationID(model.OperationOverrideReset, app.InstallationType, app.Name+":"+scope),
+		Kind:         model.OperationOverrideReset,
+		Target:       app.Name,
+		Installation: app.InstallationType,
+		Args:         []string{"flatpak", "override", overrideScopeFlag(app, scope), "--reset", app.Name},
+	}
 }
 
-// Function to generate Flatpak commands to add repositories
-func generateEnvAddCommands(envs []model.Environment) []string {
-	var commands []string
+// Function to generate Flatpak operations to add repositories
+func generateEnvAddOperations(envs []model.Environment) []model.Operation {
+	var operations []model.Operation
 
 	for _, env := range envs {
-		for name, remote := range env.Remotes {
-			// Here we need to create a temporary remote flatpakrepo file.
-			// Create a temporary file but don't delete it
-			file, errs := ioutil.TempFile("", "*.flatpakrepo")
-			if errs != nil {
-			   fmt.Println(errs)
-			   return []string{} 
-			}
-			text := ConvertMapToText(remote)
-			// Write some text to the file
-			_, errs = file.WriteString(text)
-			if errs != nil {
-			   fmt.Println(errs)
-			   return []string{} 
-			}
-	        	// Close the file
-			errs = file.Close()
-			if errs != nil {
-			   fmt.Println(errs)
-			   return []string{} 
-			}
-		
-
-			cmd := fmt.Sprintf("flatpak remote-add --%s --if-not-exists %s file://%s ",  env.InstallationType, name, file.Name())
-			// Adds no verification if it is needed.
-			if verify, ok := remote["gpg-verify"]; ok && verify == "false" {
-				cmd += "--no-gpg-verify"
-			}
-
-			commands = append(commands, cmd)
+		for _, name := range sortedRemoteNames(env.Remotes) {
+			op := remoteAddOperation(env.InstallationType, name, env.Remotes[name])
+			revert := remoteDeleteOperation(env.InstallationType, name)
+			op.Revert = &revert
+			operations = append(operations, op)
 		}
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to remove repositories
-func generateEnvRemoveCommands(envs []model.Environment) []string {
-	var commands []string
+// Function to generate Flatpak operations to remove repositories
+func generateEnvRemoveOperations(envs []model.Environment) []model.Operation {
+	var operations []model.Operation
 
 	for _, env := range envs {
-		for name, _ := range env.Remotes {
-			cmd := fmt.Sprintf("flatpak remote-delete --%s %s", env.InstallationType, name)
-			commands = append(commands, cmd)
+		for _, name := range sortedRemoteNames(env.Remotes) {
+			op := remoteDeleteOperation(env.InstallationType, name)
+			// The removed remote is complete, so it can be added again
+			revert := remoteAddOperation(env.InstallationType, name, env.Remotes[name])
+			op.Revert = &revert
+			operations = append(operations, op)
 		}
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to update repositories
-func generateEnvUpdateCommands(envs []model.Environment) []string {
-	var commands []string
+// Function to generate Flatpak operations to update repositories.
+// Modifications are not reversible: the diff only holds the new values of the options.
+func generateEnvUpdateOperations(envs []model.Environment) []model.Operation {
+	var operations []model.Operation
 
 	for _, env := range envs {
-		for name, remote := range env.Remotes {
-			options := ConvertMapToOptions(remote)
-			cmd := fmt.Sprintf("flatpak remote-modify %s --%s %s ", options, env.InstallationType, name)
-			commands = append(commands, cmd)
+		for _, name := range sortedRemoteNames(env.Remotes) {
+			options, files := ConvertMapToOptions(env.Remotes[name], fmt.Sprintf("%s-%s.gpg", name, env.InstallationType))
+			args := append([]string{"flatpak", "remote-modify"}, options...)
+			args = append(args, utility.InstallationFlag(env.InstallationType), name)
+			operations = append(operations, model.Operation{
+				ID:           operationID(model.OperationRemoteModify, env.InstallationType, name),
+				Kind:         model.OperationRemoteModify,
+				Target:       name,
+				Installation: env.InstallationType,
+				Args:         args,
+				Files:        files,
+			})
 		}
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to install applications
-func generateAppInstallCommands(apps []model.FlatpakApplication) []string {
-	var commands []string
+// Function to generate Flatpak operations to install applications
+func generateAppInstallOperations(apps []model.FlatpakApplication) []model.Operation {
+	var operations []model.Operation
 
 	for _, app := range apps {
-		cmd := fmt.Sprintf("flatpak install %s %s --%s --assumeyes", app.Repo, app.Name, app.InstallationType)
-		commands = append(commands, cmd)
+		var args []string
+		switch app.Source {
+		case model.SourceBundle:
+			args = []string{"flatpak", "install", utility.InstallationFlag(app.InstallationType), "--assumeyes", "--bundle", app.Path}
+		case model.SourceFlatpakRef:
+			args = []string{"flatpak", "install", utility.InstallationFlag(app.InstallationType), "--assumeyes", "--from", app.Path}
+		default:
+			args = []string{"flatpak", "install", app.Repo, app.Name, utility.InstallationFlag(app.InstallationType), "--assumeyes"}
+		}
+		revert := uninstallOperation(app)
+		operations = append(operations, model.Operation{
+			ID:           operationID(model.OperationInstall, app.InstallationType, app.Name),
+			Kind:         model.OperationInstall,
+			Target:       app.Name,
+			Remote:       app.Repo,
+			Installation: app.InstallationType,
+			Args:         args,
+			Revert:       &revert,
+		})
+		// Overrides left by a previous installation are dropped in exact mode
+		if app.OverrideMode == model.OverrideModeExact {
+			operations = append(operations, overrideResetOperation(app, "system"))
+			operations = append(operations, overrideResetOperation(app, "user"))
+		}
 		// Adds permissions if exists
 		if len(app.Overrides) != 0 {
-			cmd = fmt.Sprintf("flatpak override --system %s ", app.Name)
-			for _, value := range app.Overrides {
-				cmd += fmt.Sprintf("%s ", value)
-			}
-			commands = append(commands, cmd)
+			operations = append(operations, overrideOperation(app, "system", app.Overrides))
 		}
 		if len(app.OverridesUser) != 0 {
-			cmd = fmt.Sprintf("flatpak override --user %s ", app.Name)
-			for _, value := range app.OverridesUser {
-				cmd += fmt.Sprintf("%s ", value)
-			}
-			commands = append(commands, cmd)
+			operations = append(operations, overrideOperation(app, "user", app.OverridesUser))
 		}
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to uninstall applications
-func generateAppUninstallCommands(apps []model.FlatpakApplication) []string {
-	var commands []string
+// Function to generate Flatpak operations to uninstall applications.
+// Uninstalls are not reversible: the installed commit and the data of the application are lost.
+func generateAppUninstallOperations(apps []model.FlatpakApplication) []model.Operation {
+	var operations []model.Operation
 
 	for _, app := range apps {
-		cmd := fmt.Sprintf("flatpak uninstall --%s --assumeyes %s", app.InstallationType, app.Name)
-		commands = append(commands, cmd)
+		operations = append(operations, uninstallOperation(app))
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to replace permissions (overrides)
-func generateAppPermissionsCommands(added, removed []model.FlatpakApplication) []string {
-	var commands []string
+// Function to generate Flatpak operations to add permissions (overrides)
+func generateAppPermissionsOperations(added []model.FlatpakApplication) []model.Operation {
+	var operations []model.Operation
 
 	for _, app := range added {
 		if len(app.Overrides) != 0 {
-			cmd := fmt.Sprintf("flatpak override --system %s ", app.Name)
-			for _, value := range app.Overrides {
-				cmd += fmt.Sprintf("%s ", value)
-			}
-			commands = append(commands, cmd)
+			operations = append(operations, overrideOperation(app, "system", app.Overrides))
 		}
 		if len(app.OverridesUser) != 0 {
-			cmd := fmt.Sprintf("flatpak override --user %s ", app.Name)
-			for _, value := range app.OverridesUser {
-				cmd += fmt.Sprintf("%s ", value)
-			}
-			commands = append(commands, cmd)
+			operations = append(operations, overrideOperation(app, "user", app.OverridesUser))
 		}
 	}
-	
-	for _, app := range removed {
-		if len(app.Overrides) != 0 {
-			cmd := fmt.Sprintf("flatpak override --system %s ", app.Name)
-			for _, value := range app.Overrides {
-				cmd += fmt.Sprintf("%s ", value)
-			}
-			commands = append(commands, cmd)
+
+	return operations
+}
+
+// Function to generate Flatpak operations to reset and reapply overrides (exact mode)
+func generateOverrideResetOperations(resets []state.OverrideReset) []model.Operation {
+	var operations []model.Operation
+
+	for _, reset := range resets {
+		// Describe the effective change, the reset alone would hide it
+		comment := fmt.Sprintf("%s %s overrides", reset.App.Name, reset.Scope)
+		if len(reset.Added) != 0 {
+			comment += fmt.Sprintf(", add: %s", strings.Join(reset.Added, " "))
 		}
-		if len(app.OverridesUser) != 0 {
-			cmd := fmt.Sprintf("flatpak override --user %s ", app.Name)
-			for _, value := range app.OverridesUser {
-				cmd += fmt.Sprintf("%s ", utility.NegateFlag(value))
-			}
-			commands = append(commands, cmd)
+		if len(reset.Removed) != 0 {
+			comment += fmt.Sprintf(", remove: %s", strings.Join(reset.Removed, " "))
+		}
+		op := overrideResetOperation(reset.App, reset.Scope)
+		op.Comment = comment
+		operations = append(operations, op)
+		if len(reset.Flags) != 0 {
+			operations = append(operations, overrideOperation(reset.App, reset.Scope, reset.Flags))
 		}
 	}
 
-	return commands
+	return operations
 }
 
-// Function to generate Flatpak commands to replace dynamic permissions
-func generateAppDynamicPermissionsCommands(added, removed []model.FlatpakApplication) []string {
-	var commands []string
+// Function to generate Flatpak operations to replace dynamic permissions
+func generateAppDynamicPermissionsOperations(added, removed []model.FlatpakApplication) []model.Operation {
+	var operations []model.Operation
 	// Order is important. to apply changes....
 	// Delete =remove
 	// Add = add
 	// Change = remove, add
-	// First remove	
+	// The graph runs the removals of an application before its additions.
 	for _, app := range removed {
 		for _, p := range app.Permissions {
-			cmd := fmt.Sprintf("flatpak permission-remove \"%s\" \"%s\" \"%s\" ", p.Table, p.Object, app.Name)
-			commands = append(commands, cmd)
+			op, revert := permissionRemoveOperation(app, p), permissionSetOperation(app, p)
+			op.Revert = &revert
+			operations = append(operations, op)
 		}
 	}
-	// then add
 	for _, app := range added {
 		for _, p := range app.Permissions {
-			cmd := fmt.Sprintf("flatpak permission-set --data=\"%s\" \"%s\" \"%s\" \"%s\" \"%s\" ", p.Data, p.Table, p.Object, app.Name, p.Permission)
-			commands = append(commands, cmd)
+			op, revert := permissionSetOperation(app, p), permissionRemoveOperation(app, p)
+			op.Revert = &revert
+			operations = append(operations, op)
 		}
 	}
-	return commands
+	return operations
 }
 
-func GenDiffStateCommands(diff state.DiffState) []string {
-	var commands []string
+// permissionRemoveOperation removes a dynamic permission of an application
+func permissionRemoveOperation(app model.FlatpakApplication, p model.Permission) model.Operation {
+	target := fmt.Sprintf("%s:%s/%s", app.Name, p.Table, p.Object)
+	return model.Operation{
+		ID:           operationID(model.OperationPermissionRemove, app.InstallationType, target),
+		Kind:         model.OperationPermissionRemove,
+		Target:       app.Name,
+		Installation: app.InstallationType,
+		Args:         []string{"flatpak", "permission-remove", p.Table, p.Object, app.Name},
+	}
+}
+
+// permissionSetOperation sets a dynamic permission of an application
+func permissionSetOperation(app model.FlatpakApplication, p model.Permission) model.Operation {
+	target := fmt.Sprintf("%s:%s/%s", app.Name, p.Table, p.Object)
+	return model.Operation{
+		ID:           operationID(model.OperationPermissionSet, app.InstallationType, target),
+		Kind:         model.OperationPermissionSet,
+		Target:       app.Name,
+		Installation: app.InstallationType,
+		Args:         []string{"flatpak", "permission-set", "--data=" + p.Data, p.Table, p.Object, app.Name, p.Permission},
+	}
+}
+
+// Function to generate Flatpak operations to mask or unmask the updates of applications
+func generateMaskOperations(added, removed []model.FlatpakApplication) []model.Operation {
+	var operations []model.Operation
+
+	mask := func(app model.FlatpakApplication) model.Operation {
+		return model.Operation{
+			ID:           operationID(model.OperationMask, app.InstallationType, app.Name),
+			Kind:         model.OperationMask,
+			Target:       app.Name,
+			Installation: app.InstallationType,
+			Args:         []string{"flatpak", "mask", utility.InstallationFlag(app.InstallationType), app.Name},
+		}
+	}
+	unmask := func(app model.FlatpakApplication) model.Operation {
+		return model.Operation{
+			ID:           operationID(model.OperationUnmask, app.InstallationType, app.Name),
+			Kind:         model.OperationUnmask,
+			Target:       app.Name,
+			Installation: app.InstallationType,
+			Args:         []string{"flatpak", "mask", utility.InstallationFlag(app.InstallationType), "--remove", app.Name},
+		}
+	}
+
+	for _, app := range added {
+		op, revert := mask(app), unmask(app)
+		op.Revert = &revert
+		operations = append(operations, op)
+	}
+	for _, app := range removed {
+		op, revert := unmask(app), mask(app)
+		op.Revert = &revert
+		operations = append(operations, op)
+	}
+
+	return operations
+}
+
+// Function to generate Flatpak operations to update applications and runtimes
+func generateUpdateOperations(updates []state.Update) []model.Operation {
+	var operations []model.Operation
+
+	for _, update := range updates {
+		operations = append(operations, model.Operation{
+			ID:           operationID(model.OperationUpdate, update.InstallationType, update.Ref),
+			Kind:         model.OperationUpdate,
+			Target:       update.Ref,
+			Installation: update.InstallationType,
+			Args:         []string{"flatpak", "update", utility.InstallationFlag(update.InstallationType), "--assumeyes", update.Ref},
+			Comment:      fmt.Sprintf("update requested by %s", update.Reason),
+		})
+	}
+
+	return operations
+}
+
+// Function to generate Flatpak operations to remove unused runtimes
+func generatePruneOperations(prunes []state.Prune) []model.Operation {
+	var operations []model.Operation
+
+	for _, prune := range prunes {
+		var comments []string
+		for _, runtime := range prune.Runtimes {
+			comments = append(comments, fmt.Sprintf("unused runtime: %s", runtime))
+		}
+		operations = append(operations, model.Operation{
+			ID:           operationID(model.OperationPrune, prune.InstallationType, "unused"),
+			Kind:         model.OperationPrune,
+			Installation: prune.InstallationType,
+			Args:         []string{"flatpak", "uninstall", utility.InstallationFlag(prune.InstallationType), "--unused", "--assumeyes"},
+			Comment:      strings.Join(comments, "\n"),
+		})
+	}
+
+	return operations
+}
+
+// GenDiffStateOperations returns the operations of the diff, ordered by group.
+// BuildOperationGraph orders them by their dependencies.
+func GenDiffStateOperations(diff state.DiffState) []model.Operation {
+	var operations []model.Operation
+
+	operations = append(operations, generateEnvRemoveOperations(diff.EnvToRemove)...)
+
+	// Generate operations for repositories
+	operations = append(operations, generateEnvAddOperations(diff.EnvToAdd)...)
+	operations = append(operations, generateEnvUpdateOperations(diff.EnvToUpdate)...)
+
+	operations = append(operations, generateAppUninstallOperations(diff.AppsToRemove)...)
+
+	// Generate operations for applications
+	operations = append(operations, generateAppInstallOperations(diff.AppsToAdd)...)
+
+	// Generate operations for update masks
+	operations = append(operations, generateMaskOperations(diff.MasksToAdd, diff.MasksToRemove)...)
 
-	envRemoveCommands := generateEnvRemoveCommands(diff.EnvToRemove)
-	commands = append(commands, envRemoveCommands...)
+	// Generate operations for updates
+	operations = append(operations, generateUpdateOperations(diff.Updates)...)
 
-	// Generate commands for repositories
-	envAddCommands := generateEnvAddCommands(diff.EnvToAdd)
-	commands = append(commands, envAddCommands...)
+	// Generate operations for unused runtimes
+	operations = append(operations, generatePruneOperations(diff.Prunes)...)
 
-	// Generate commands for repositories
-	envUpdateCommands := generateEnvUpdateCommands(diff.EnvToUpdate)
-	commands = append(commands, envUpdateCommands...)
+	// Generate operations for replacing permissions
+	operations = append(operations, generateAppPermissionsOperations(diff.PermToAdd)...)
 
-	appUninstallCommands := generateAppUninstallCommands(diff.AppsToRemove)
-	commands = append(commands, appUninstallCommands...)
+	// Generate operations for overrides in exact mode
+	operations = append(operations, generateOverrideResetOperations(diff.OverridesToReset)...)
 
-	// Generate commands for applications
-	appInstallCommands := generateAppInstallCommands(diff.AppsToAdd)
-	commands = append(commands, appInstallCommands...)
+	// Generate operations for replacing permissions
+	operations = append(operations, generateAppDynamicPermissionsOperations(diff.DynamicPermToAdd, diff.DynamicPermToRemove)...)
 
-	// Generate commands for replacing permissions
-	permAddRemoveCommands := generateAppPermissionsCommands(diff.PermToAdd,diff.PermToRemove)
-	commands = append(commands, permAddRemoveCommands...)
+	return operations
+}
+
+// GenDiffStateCommands returns the shell commands of the diff in execution order.
+// Comments describing the next command start with "#". The files of the operations,
+// such as .flatpakrepo files, are written in a temporary directory kept for the commands.
+func GenDiffStateCommands(diff state.DiffState) []string {
+	var commands []string
+
+	operations, err := BuildOperationGraph(GenDiffStateOperations(diff))
+	if err != nil {
+		fmt.Println(err)
+		return commands
+	}
+	var dir string
+	for _, op := range operations {
+		if len(op.Files) == 0 {
+			continue
+		}
+		dir, err = os.MkdirTemp("", "flatpak-compose-")
+		if err == nil {
+			err = writeOperationFiles(operations, dir)
+		}
+		if err != nil {
+			fmt.Println(err)
+			return commands
+		}
+		break
+	}
+	for _, op := range operations {
+		commands = append(commands, renderOperation(op, dir)...)
+	}
 
-	// Generate commands for replacing permissions
-	dynamicPermAddRemoveCommands := generateAppDynamicPermissionsCommands(diff.DynamicPermToAdd,diff.DynamicPermToRemove)
-	commands = append(commands, dynamicPermAddRemoveCommands...)
-	
 	return commands
 }
@@ -0,0 +1,186 @@
+package view
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
+)
+
+// updateAppID returns the application id of the ref of an update (id/arch/branch)
+func updateAppID(ref string) string {
+	return strings.SplitN(ref, "/", 2)[0]
+}
+
+// dependsOn reports whether the operation next must run after the operation prev
+func dependsOn(next, prev model.Operation) bool {
+	sameInstallation := next.Installation == prev.Installation
+	switch next.Kind {
+	case model.OperationRemoteAdd:
+		// A remote moved to other options is deleted and added again
+		return prev.Kind == model.OperationRemoteDelete && sameInstallation && prev.Target == next.Target
+	case model.OperationRemoteDelete:
+		// The applications of a remote are uninstalled before it
+		return prev.Kind == model.OperationUninstall && sameInstallation && prev.Remote == next.Target
+	case model.OperationInstall:
+		switch prev.Kind {
+		case model.OperationRemoteAdd, model.OperationRemoteModify:
+			return sameInstallation && prev.Target == next.Remote
+		case model.OperationUninstall:
+			// An application moved to another remote or installation
+			return prev.Target == next.Target
+		}
+	case model.OperationOverride, model.OperationOverrideReset, model.OperationMask, model.OperationUnmask,
+		model.OperationPermissionRemove, model.OperationPermissionSet:
+		if prev.Kind == model.OperationInstall {
+			return sameInstallation && prev.Target == next.Target
+		}
+		// Overrides are reapplied after a reset, permissions are set after their removal
+		if next.Kind == model.OperationOverride && prev.Kind == model.OperationOverrideReset {
+			return prev.Target == next.Target
+		}
+		if next.Kind == model.OperationPermissionSet && prev.Kind == model.OperationPermissionRemove {
+			return prev.Target == next.Target
+		}
+	case model.OperationUpdate:
+		switch prev.Kind {
+		case model.OperationRemoteAdd, model.OperationRemoteModify:
+			return sameInstallation
+		case model.OperationInstall, model.OperationMask, model.OperationUnmask:
+			return sameInstallation && prev.Target == updateAppID(next.Target)
+		}
+	case model.OperationPrune:
+		// Runtimes are unused once the applications are removed, installed and updated
+		switch prev.Kind {
+		case model.OperationUninstall, model.OperationInstall, model.OperationUpdate:
+			return sameInstallation
+		}
+	}
+	return false
+}
+
+// BuildOperationGraph links the operations with their dependencies and returns them in execution order.
+// Operations without a dependency between them keep their original order.
+func BuildOperationGraph(operations []model.Operation) ([]model.Operation, error) {
+	// Identifiers are made unique, e.g. overrides added and removed in the same scope
+	seen := make(map[string]int)
+	for i := range operations {
+		id := operations[i].ID
+		seen[id]++
+		if seen[id] > 1 {
+			operations[i].ID = fmt.Sprintf("%s#%d", id, seen[id])
+		}
+	}
+
+	index := make(map[string]int)
+	for i, op := range operations {
+		index[op.ID] = i
+	}
+	for i := range operations {
+		for j := range operations {
+			if i != j && dependsOn(operations[i], operations[j]) {
+				operations[i].DependsOn = append(operations[i].DependsOn, operations[j].ID)
+			}
+		}
+	}
+
+	// Topological sort, the first ready operation in the original order runs first
+	pending := make([]int, len(operations))
+	dependents := make([][]int, len(operations))
+	for i, op := range operations {
+		for _, dep := range op.DependsOn {
+			j, ok := index[dep]
+			if !ok {
+				return nil, fmt.Errorf("operation %s depends on unknown operation %s", op.ID, dep)
+			}
+			pending[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+	done := make([]bool, len(operations))
+	var sorted []model.Operation
+	for len(sorted) < len(operations) {
+		next := -1
+		for i := range operations {
+			if !done[i] && pending[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next == -1 {
+			var cycle []string
+			for i, op := range operations {
+				if !done[i] {
+					cycle = append(cycle, op.ID)
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between operations: %s", strings.Join(cycle, ", "))
+		}
+		done[next] = true
+		sorted = append(sorted, operations[next])
+		for _, i := range dependents[next] {
+			pending[i]--
+		}
+	}
+	return sorted, nil
+}
+
+// shellQuote quotes an argument for sh when it contains special characters.
+// Braces and commas are quoted too, bash expands a{b,c} to two words.
+func shellQuote(arg string) string {
+	if arg == "" {
+		return "''"
+	}
+	safe := true
+	for _, c := range arg {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_./:=@%+", c)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// renderCommand renders the arguments of an operation as a shell command
+func renderCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// operationFilePath returns the path of the operation files written in dir
+func operationFilePath(dir string) func(file model.OperationFile) string {
+	return func(file model.OperationFile) string {
+		return filepath.Join(dir, file.Name)
+	}
+}
+
+// writeOperationFiles writes the files of the operations in dir
+func writeOperationFiles(operations []model.Operation, dir string) error {
+	for _, op := range operations {
+		for _, file := range op.Files {
+			if err := os.WriteFile(filepath.Join(dir, file.Name), file.Data, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderOperation renders an operation as its comment lines followed by its command.
+// The file placeholders are replaced with the paths of the files written in dir.
+func renderOperation(op model.Operation, dir string) []string {
+	var lines []string
+	if op.Comment != "" {
+		for _, line := range strings.Split(op.Comment, "\n") {
+			lines = append(lines, "# "+line)
+		}
+	}
+	return append(lines, renderCommand(op.ResolveArgs(operationFilePath(dir))))
+}
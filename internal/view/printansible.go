@@ -0,0 +1,197 @@
+package view
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/state"
+	"github.com/faan11/flatpak-compose/internal/utility"
+	"gopkg.in/yaml.v2"
+)
+
+// ansibleDirVar is the registered variable holding the directory of the files of the operations
+const ansibleDirVar = "flatpak_compose_dir"
+
+// ansibleDirPath is the Jinja expression of the directory of the files of the operations
+const ansibleDirPath = "{{ " + ansibleDirVar + ".path }}"
+
+// GenOperationsPlaybook converts operations to an Ansible playbook. Remotes and applications of the
+// user and system installations use the community.general.flatpak_remote and community.general.flatpak
+// modules, the other operations are shell tasks guarded like the steps of GenDiffStateScript.
+func GenOperationsPlaybook(operations []model.Operation) ([]byte, error) {
+	operations, err := BuildOperationGraph(operations)
+	if err != nil {
+		return nil, err
+	}
+
+	var tasks []yaml.MapSlice
+	hasFiles := false
+	for _, op := range operations {
+		if len(op.Files) != 0 {
+			hasFiles = true
+		}
+	}
+	if hasFiles {
+		tasks = append(tasks, yaml.MapSlice{
+			{Key: "name", Value: "Create a directory for the remote files"},
+			{Key: "ansible.builtin.tempfile", Value: yaml.MapSlice{
+				{Key: "state", Value: "directory"},
+				{Key: "suffix", Value: ".flatpak-compose"},
+			}},
+			{Key: "register", Value: ansibleDirVar},
+		})
+	}
+	for _, op := range operations {
+		tasks = append(tasks, ansibleTasks(op)...)
+	}
+	if hasFiles {
+		tasks = append(tasks, yaml.MapSlice{
+			{Key: "name", Value: "Remove the directory of the remote files"},
+			{Key: "ansible.builtin.file", Value: yaml.MapSlice{
+				{Key: "path", Value: ansibleDirPath},
+				{Key: "state", Value: "absent"},
+			}},
+		})
+	}
+
+	playbook := []yaml.MapSlice{{
+		{Key: "name", Value: "Apply the flatpak-compose state"},
+		{Key: "hosts", Value: "all"},
+		{Key: "tasks", Value: tasks},
+	}}
+	return yaml.Marshal(playbook)
+}
+
+// PrintDiffPlaybook prints the operations of the diff as an Ansible playbook
+func PrintDiffPlaybook(diff state.DiffState) {
+	printPlaybook(GenDiffStateOperations(diff))
+}
+
+// GenStatePlaybook converts a state to an Ansible playbook creating it from scratch.
+// The dynamic permissions are only compared for installed applications, the ones of
+// every application of the state are set.
+func GenStatePlaybook(s model.State) ([]byte, error) {
+	diff := state.GetDiffState(model.State{}, s)
+	diff.DynamicPermToAdd = nil
+	for _, app := range s.Applications {
+		if len(app.Permissions) != 0 {
+			diff.DynamicPermToAdd = append(diff.DynamicPermToAdd, app)
+		}
+	}
+	return GenOperationsPlaybook(GenDiffStateOperations(diff))
+}
+
+// PrintStatePlaybook prints an Ansible playbook creating the state from scratch
+func PrintStatePlaybook(s model.State) {
+	writePlaybook(GenStatePlaybook(s))
+}
+
+func printPlaybook(operations []model.Operation) {
+	writePlaybook(GenOperationsPlaybook(operations))
+}
+
+func writePlaybook(playbook []byte, err error) {
+	if err != nil {
+		// Nothing is written, a redirected playbook would contain the error
+		log.Fatalf("Error generating the playbook: %v \n", err)
+	}
+	fmt.Print(string(playbook))
+}
+
+// ansibleTasks converts an operation to tasks
+func ansibleTasks(op model.Operation) []yaml.MapSlice {
+	name := describeOperation(op)
+	if op.Comment != "" {
+		name += " (" + strings.ReplaceAll(op.Comment, "\n", ", ") + ")"
+	}
+	// The modules only know the user and system installations
+	method := op.Installation
+	if method != utility.UserInstallationType && method != utility.SystemInstallationType {
+		return []yaml.MapSlice{ansibleShellTask(name, op)}
+	}
+
+	switch op.Kind {
+	case model.OperationRemoteAdd:
+		// The .flatpakrepo file cannot disable the GPG verification
+		if len(op.Files) != 1 || !isScriptText(op.Files[0].Data) || hasArg(op.Args, "--no-gpg-verify") {
+			break
+		}
+		file := op.Files[0]
+		return []yaml.MapSlice{
+			{
+				{Key: "name", Value: fmt.Sprintf("Write %s", file.Name)},
+				{Key: "ansible.builtin.copy", Value: yaml.MapSlice{
+					{Key: "dest", Value: ansibleDirPath + "/" + file.Name},
+					{Key: "content", Value: string(file.Data)},
+					{Key: "mode", Value: "0600"},
+				}},
+			},
+			{
+				{Key: "name", Value: name},
+				{Key: "community.general.flatpak_remote", Value: yaml.MapSlice{
+					{Key: "name", Value: op.Target},
+					{Key: "flatpakrepo_url", Value: ansibleDirPath + "/" + file.Name},
+					{Key: "method", Value: method},
+					{Key: "state", Value: "present"},
+				}},
+			},
+		}
+	case model.OperationRemoteDelete:
+		return []yaml.MapSlice{{
+			{Key: "name", Value: name},
+			{Key: "community.general.flatpak_remote", Value: yaml.MapSlice{
+				{Key: "name", Value: op.Target},
+				{Key: "method", Value: method},
+				{Key: "state", Value: "absent"},
+			}},
+		}}
+	case model.OperationInstall:
+		// Bundles and .flatpakref files are installed with flatpak
+		if hasArg(op.Args, "--bundle") || hasArg(op.Args, "--from") {
+			break
+		}
+		return []yaml.MapSlice{{
+			{Key: "name", Value: name},
+			{Key: "community.general.flatpak", Value: yaml.MapSlice{
+				{Key: "name", Value: op.Target},
+				{Key: "remote", Value: op.Remote},
+				{Key: "method", Value: method},
+				{Key: "state", Value: "present"},
+			}},
+		}}
+	case model.OperationUninstall:
+		return []yaml.MapSlice{{
+			{Key: "name", Value: name},
+			{Key: "community.general.flatpak", Value: yaml.MapSlice{
+				{Key: "name", Value: op.Target},
+				{Key: "method", Value: method},
+				{Key: "state", Value: "absent"},
+			}},
+		}}
+	}
+	return []yaml.MapSlice{ansibleShellTask(name, op)}
+}
+
+// ansibleShellTask runs an operation as the shell commands of GenDiffStateScript,
+// with its files written in the directory of the play
+func ansibleShellTask(name string, op model.Operation) yaml.MapSlice {
+	task := yaml.MapSlice{
+		{Key: "name", Value: name},
+		{Key: "ansible.builtin.shell", Value: strings.Join(scriptStep(op), "\n") + "\n"},
+	}
+	if len(op.Files) != 0 {
+		task = append(task, yaml.MapItem{Key: "environment", Value: yaml.MapSlice{{Key: "workdir", Value: ansibleDirPath}}})
+	}
+	return task
+}
+
+// hasArg reports whether the arguments contain arg
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package view
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/faan11/flatpak-compose/internal/model"
+	"gopkg.in/yaml.v2"
+)
+
+func TestGenStatePlaybookDynamicPermissions(t *testing.T) {
+	s := model.State{
+		Environment: []model.Environment{{
+			InstallationType: "user",
+			Remotes:          map[string]map[string]string{"flathub": {"url": "https://dl.flathub.org/repo/"}},
+		}},
+		Applications: []model.FlatpakApplication{{
+			Name:             "org.example.App",
+			Repo:             "flathub",
+			Branch:           "stable",
+			InstallationType: "user",
+			Permissions: []model.Permission{
+				{Table: "devices", Object: "camera", Permission: "yes"},
+				{Table: "notifications", Object: "notification", Permission: "no", Data: "0x00"},
+			},
+		}},
+	}
+	data, err := GenStatePlaybook(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var playbook []struct {
+		Tasks []map[string]interface{} `yaml:"tasks"`
+	}
+	if err := yaml.Unmarshal(data, &playbook); err != nil {
+		t.Fatalf("%v\n%s", err, data)
+	}
+	if len(playbook) != 1 {
+		t.Fatalf("got %d plays\n%s", len(playbook), data)
+	}
+
+	install, permissions := -1, []int{}
+	for i, task := range playbook[0].Tasks {
+		if module, ok := task["community.general.flatpak"].(map[interface{}]interface{}); ok && module["name"] == "org.example.App" {
+			install = i
+		}
+		if shell, ok := task["ansible.builtin.shell"].(string); ok && strings.Contains(shell, "flatpak permission-set") {
+			permissions = append(permissions, i)
+			if !strings.Contains(shell, "org.example.App") {
+				t.Errorf("permission task %d does not set the application:\n%s", i, shell)
+			}
+		}
+	}
+	if install < 0 {
+		t.Fatalf("no install task\n%s", data)
+	}
+	if len(permissions) != 2 {
+		t.Fatalf("got %d permission-set tasks, want 2\n%s", len(permissions), data)
+	}
+	for _, i := range permissions {
+		if i < install {
+			t.Errorf("permission task %d runs before the install task %d", i, install)
+		}
+	}
+	for _, want := range []string{"devices camera org.example.App yes", "notifications notification org.example.App no"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("missing %q\n%s", want, data)
+		}
+	}
+}
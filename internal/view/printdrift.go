@@ -0,0 +1,46 @@
+package view
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"github.com/faan11/flatpak-compose/internal/state"
+)
+
+// formatDriftValue shows absent items explicitly
+func formatDriftValue(value string) string {
+	if value == "" {
+		return "(absent)"
+	}
+	if len(value) > 40 {
+		return value[:37] + "..."
+	}
+	return value
+}
+
+// PrintDrift prints the items that differ between the last-applied, desired and actual states
+func PrintDrift(drift []state.DriftItem) {
+	if len(drift) == 0 {
+		fmt.Println("No drift: the system matches the last applied state and the compose file")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CAUSE\tKIND\tITEM\tLAST-APPLIED\tDESIRED\tACTUAL")
+	for _, item := range drift {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", item.Cause, item.Kind, item.Name,
+			formatDriftValue(item.LastApplied), formatDriftValue(item.Desired), formatDriftValue(item.Actual))
+	}
+	w.Flush()
+	fmt.Println("\nmanual: changed on the system outside of flatpak-compose, compose: changed in the compose file, both: changed in both places")
+}
+
+// PrintOrphanedOverrides prints the override files of applications that are not installed
+func PrintOrphanedOverrides(orphaned []state.OrphanedOverride) {
+	if len(orphaned) == 0 {
+		return
+	}
+	fmt.Println("\nOrphaned overrides (no installed application):")
+	for _, override := range orphaned {
+		fmt.Printf("  %s %s\n", override.Scope, override.App)
+	}
+}
@@ -0,0 +1,129 @@
+package view
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// nixIdentifier matches the attribute names that do not need quotes
+var nixIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_'-]*$`)
+
+// nixString quotes a Nix string
+func nixString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "${", `\${`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\t", `\t`)
+	return `"` + value + `"`
+}
+
+// nixAttrName returns an attribute name, quoted when needed
+func nixAttrName(name string) string {
+	if nixIdentifier.MatchString(name) {
+		return name
+	}
+	return nixString(name)
+}
+
+// nixRemoteLocation returns the location of a remote: a .flatpakrepo file written in the store,
+// so that the GPG key and the other options of the remote are kept
+func nixRemoteLocation(name string, remote map[string]string) string {
+	if location, ok := remote[model.RemoteFromURL]; ok {
+		return nixString(location)
+	}
+	return fmt.Sprintf("builtins.toFile %s %s", nixString(name+".flatpakrepo"), nixString(ConvertMapToText(remote)))
+}
+
+// GenStateNix converts the applications, remotes and overrides of an installation to a module setting
+// the services.flatpak options of nix-flatpak. state.GetNixState performs the reverse conversion.
+// The overrides are the ones of the scope of the installation, user or system.
+func GenStateNix(s model.State, installationType string) string {
+	var lines []string
+	lines = append(lines, "{", "  services.flatpak = {")
+	// The NixOS option enabling flatpak, home-manager has none
+	if installationType == utility.SystemInstallationType {
+		lines = append(lines, "    enable = true;")
+	}
+
+	lines = append(lines, "    remotes = [")
+	for _, env := range s.Environment {
+		if env.InstallationType != installationType {
+			continue
+		}
+		for _, name := range sortedRemoteNames(env.Remotes) {
+			lines = append(lines, fmt.Sprintf("      { name = %s; location = %s; }", nixString(name), nixRemoteLocation(name, env.Remotes[name])))
+		}
+	}
+	lines = append(lines, "    ];")
+
+	lines = append(lines, "    packages = [")
+	var overridden []model.FlatpakApplication
+	for _, app := range s.Applications {
+		if app.InstallationType != installationType {
+			continue
+		}
+		appID := app.Name
+		if app.Branch != "" && app.Branch != "stable" {
+			appID += "//" + app.Branch
+		}
+		switch app.Source {
+		case model.SourceBundle:
+			lines = append(lines, fmt.Sprintf("      { appId = %s; bundle = %s; }", nixString(appID), nixString("file://"+app.Path)))
+		case model.SourceFlatpakRef:
+			lines = append(lines, fmt.Sprintf("      { appId = %s; flatpakref = %s; }", nixString(appID), nixString(app.Path)))
+		default:
+			lines = append(lines, fmt.Sprintf("      { appId = %s; origin = %s; }", nixString(appID), nixString(app.Repo)))
+		}
+		if len(nixOverrides(app, installationType)) != 0 {
+			overridden = append(overridden, app)
+		}
+	}
+	lines = append(lines, "    ];")
+
+	lines = append(lines, "    overrides = {")
+	for _, app := range overridden {
+		lines = append(lines, fmt.Sprintf("      %s = {", nixAttrName(app.Name)))
+		k := utility.OverrideFlagsToKeyFile(nixOverrides(app, installationType))
+		for _, group := range k.Groups() {
+			lines = append(lines, fmt.Sprintf("        %s = {", nixAttrName(group)))
+			for _, key := range k.Keys(group) {
+				var value string
+				if group == "Context" {
+					values, _ := k.StringList(group, key)
+					var quoted []string
+					for _, v := range values {
+						quoted = append(quoted, nixString(v))
+					}
+					value = "[ " + strings.Join(quoted, " ") + " ]"
+				} else {
+					v, _ := k.String(group, key)
+					value = nixString(v)
+				}
+				lines = append(lines, fmt.Sprintf("          %s = %s;", nixAttrName(key), value))
+			}
+			lines = append(lines, "        };")
+		}
+		lines = append(lines, "      };")
+	}
+	lines = append(lines, "    };")
+
+	lines = append(lines, "  };", "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// nixOverrides returns the overrides of an application in the scope managed by nix-flatpak
+func nixOverrides(app model.FlatpakApplication, installationType string) []string {
+	if installationType == utility.UserInstallationType {
+		return app.OverridesUser
+	}
+	return app.Overrides
+}
+
+// PrintStateNix prints the state of an installation as a nix-flatpak module
+func PrintStateNix(s model.State, installationType string) {
+	fmt.Print(GenStateNix(s, installationType))
+}
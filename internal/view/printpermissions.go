@@ -0,0 +1,24 @@
+package view
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// PrintEffectivePermissions prints the sandbox of an application and the layer that granted or revoked each permission
+func PrintEffectivePermissions(app model.FlatpakApplication, permissions []utility.EffectivePermission) {
+	fmt.Printf("%s (%s)\n", app.Name, app.InstallationType)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tPERMISSION\tSTATE\tLAYER\tFLAG")
+	for _, p := range permissions {
+		status := "granted"
+		if !p.Granted {
+			status = "revoked"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Kind, p.Subject, status, p.Layer, p.Flag)
+	}
+	w.Flush()
+}
@@ -0,0 +1,207 @@
+package view
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+	"github.com/faan11/flatpak-compose/internal/model"
+	"github.com/faan11/flatpak-compose/internal/state"
+	"github.com/faan11/flatpak-compose/internal/utility"
+)
+
+// scriptFileDelimiter ends the here-documents of the files embedded in a script
+const scriptFileDelimiter = "FLATPAK_COMPOSE_EOF"
+
+// GenDiffStateScript returns the operations of the diff as a standalone POSIX shell script.
+// The files of the operations, such as .flatpakrepo files and GPG keys, are embedded and
+// written in a temporary directory. Each step is guarded so that the script can be run again.
+func GenDiffStateScript(diff state.DiffState) (string, error) {
+	operations, err := BuildOperationGraph(GenDiffStateOperations(diff))
+	if err != nil {
+		return "", err
+	}
+
+	var lines []string
+	lines = append(lines, "#!/bin/sh", "# Plan generated by flatpak-compose", "set -eu")
+	for _, op := range operations {
+		if len(op.Files) != 0 {
+			lines = append(lines, "", "workdir=$(mktemp -d)", `trap 'rm -rf "$workdir"' EXIT`)
+			break
+		}
+	}
+
+	for _, op := range operations {
+		lines = append(lines, "")
+		lines = append(lines, "# "+describeOperation(op))
+		if op.Comment != "" {
+			for _, line := range strings.Split(op.Comment, "\n") {
+				lines = append(lines, "# "+line)
+			}
+		}
+		lines = append(lines, scriptStep(op)...)
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// scriptStep returns the lines of an operation: its files and its guarded command
+func scriptStep(op model.Operation) []string {
+	var lines []string
+	for _, file := range op.Files {
+		lines = append(lines, scriptFile(file)...)
+	}
+	command := renderScriptCommand(op)
+	if guard := scriptGuard(op); guard != "" {
+		return append(lines, "if "+guard+"; then", "  "+command, "fi")
+	}
+	return append(lines, command)
+}
+
+// PrintDiffScript prints the operations of the diff as a standalone shell script
+func PrintDiffScript(diff state.DiffState) {
+	script, err := GenDiffStateScript(diff)
+	if err != nil {
+		// Nothing is written, a redirected script would contain the error
+		log.Fatalf("Error generating the script: %v \n", err)
+	}
+	fmt.Print(script)
+}
+
+// describeOperation returns the description of an operation written above its command
+func describeOperation(op model.Operation) string {
+	installation := op.Installation + " installation"
+	switch op.Kind {
+	case model.OperationRemoteDelete:
+		return fmt.Sprintf("Delete remote %s from the %s", op.Target, installation)
+	case model.OperationRemoteAdd:
+		return fmt.Sprintf("Add remote %s to the %s", op.Target, installation)
+	case model.OperationRemoteModify:
+		return fmt.Sprintf("Modify remote %s of the %s", op.Target, installation)
+	case model.OperationUninstall:
+		return fmt.Sprintf("Uninstall %s from the %s", op.Target, installation)
+	case model.OperationInstall:
+		return fmt.Sprintf("Install %s in the %s", op.Target, installation)
+	case model.OperationOverride:
+		return fmt.Sprintf("Set overrides of %s", op.Target)
+	case model.OperationOverrideReset:
+		return fmt.Sprintf("Reset overrides of %s", op.Target)
+	case model.OperationPermissionRemove:
+		return fmt.Sprintf("Remove a dynamic permission of %s", op.Target)
+	case model.OperationPermissionSet:
+		return fmt.Sprintf("Set a dynamic permission of %s", op.Target)
+	case model.OperationMask:
+		return fmt.Sprintf("Mask the updates of %s in the %s", op.Target, installation)
+	case model.OperationUnmask:
+		return fmt.Sprintf("Unmask the updates of %s in the %s", op.Target, installation)
+	case model.OperationUpdate:
+		return fmt.Sprintf("Update %s in the %s", op.Target, installation)
+	case model.OperationPrune:
+		return fmt.Sprintf("Remove the unused runtimes of the %s", installation)
+	default:
+		return string(op.Kind)
+	}
+}
+
+// scriptGuard returns the condition an operation runs under, so that a second run of the
+// script skips the steps already done. Operations that can be repeated have no guard.
+func scriptGuard(op model.Operation) string {
+	flag := shellQuote(utility.InstallationFlag(op.Installation))
+	target := shellQuote(op.Target)
+	switch op.Kind {
+	case model.OperationInstall:
+		return fmt.Sprintf("! flatpak info %s %s >/dev/null 2>&1", flag, target)
+	case model.OperationUninstall:
+		return fmt.Sprintf("flatpak info %s %s >/dev/null 2>&1", flag, target)
+	case model.OperationRemoteDelete:
+		return fmt.Sprintf("flatpak remotes %s --columns=name | grep -qxF %s", flag, target)
+	case model.OperationUnmask:
+		// flatpak mask prints a header then the patterns indented
+		return fmt.Sprintf("flatpak mask %s | sed 's/^[[:space:]]*//' | grep -qxF %s", flag, target)
+	case model.OperationPermissionRemove:
+		// flatpak permission-remove <table> <id> <app>
+		table, object := op.Args[2], op.Args[3]
+		return fmt.Sprintf("flatpak permission-show %s | awk -F '\\t' -v t=%s -v o=%s '$1 == t && $2 == o { found = 1 } END { exit !found }'",
+			target, shellQuote(table), shellQuote(object))
+	default:
+		// remote-add has --if-not-exists, the other operations set a value
+		return ""
+	}
+}
+
+// renderScriptCommand renders the command of an operation, the file placeholders refer to $workdir
+func renderScriptCommand(op model.Operation) string {
+	quoted := make([]string, len(op.Args))
+	for i, arg := range op.Args {
+		quoted[i] = scriptArg(arg, op.Files)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// scriptArg quotes an argument, replacing the file placeholders with "$workdir"/<name>
+func scriptArg(arg string, files []model.OperationFile) string {
+	for _, file := range files {
+		placeholder := model.FilePlaceholder(file.Name)
+		if !strings.Contains(arg, placeholder) {
+			continue
+		}
+		parts := strings.Split(arg, placeholder)
+		for i, part := range parts {
+			if part != "" {
+				parts[i] = scriptArg(part, files)
+			}
+		}
+		return strings.Join(parts, `"$workdir"/`+shellQuote(file.Name))
+	}
+	return shellQuote(arg)
+}
+
+// scriptFile returns the lines writing a file in $workdir. Text files are embedded as they are
+// with a here-document, other files with printf octal escapes: base64 and uudecode are not always installed.
+func scriptFile(file model.OperationFile) []string {
+	path := `"$workdir"/` + shellQuote(file.Name)
+	if isScriptText(file.Data) {
+		lines := []string{fmt.Sprintf("cat > %s <<'%s'", path, scriptFileDelimiter)}
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(file.Data), "\n"), "\n")...)
+		return append(lines, scriptFileDelimiter)
+	}
+	lines := []string{"{"}
+	for data := file.Data; len(data) != 0; {
+		n := len(data)
+		if n > 32 {
+			n = 32
+		}
+		lines = append(lines, "  printf '"+printfOctal(data[:n])+"'")
+		data = data[n:]
+	}
+	return append(lines, "} > "+path)
+}
+
+// printfOctal escapes data for a printf format, letters and digits are kept and the other bytes
+// are written as three-digit octal escapes, which printf never extends with the next character
+func printfOctal(data []byte) string {
+	var b strings.Builder
+	for _, c := range data {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "\\%03o", c)
+		}
+	}
+	return b.String()
+}
+
+// isScriptText reports whether data can be embedded in a here-document unchanged:
+// UTF-8 text ending with a newline, without NUL bytes and without the delimiter line
+func isScriptText(data []byte) bool {
+	if len(data) == 0 || !bytes.HasSuffix(data, []byte("\n")) || bytes.IndexByte(data, 0) != -1 || !utf8.Valid(data) {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == scriptFileDelimiter {
+			return false
+		}
+	}
+	return true
+}
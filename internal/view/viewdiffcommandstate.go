@@ -2,6 +2,7 @@ package view
 
 import (
 	"fmt"
+	"github.com/faan11/flatpak-compose/internal/model"
 	"github.com/faan11/flatpak-compose/internal/state"
 )
 
@@ -11,6 +12,12 @@ func printShellCommands(commands []string) {
 	}
 }
 
+func printOperations(operations []model.Operation, dir string) {
+	for _, op := range operations {
+		printShellCommands(renderOperation(op, dir))
+	}
+}
+
 func PrintDiffCommands(diff state.DiffState) {
 	list := GenDiffStateCommands(diff)
 	printShellCommands(list)